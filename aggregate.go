@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	chart "github.com/wcharczuk/go-chart"
+)
+
+// aggregations combine the values of the members of a group.
+var aggregations = map[string]func(values []float64) float64{
+	"sum": func(values []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	},
+	"avg": func(values []float64) float64 {
+		return mean(values)
+	},
+	"min": func(values []float64) float64 {
+		min := math.Inf(1)
+		for _, v := range values {
+			min = math.Min(min, v)
+		}
+		return min
+	},
+	"max": func(values []float64) float64 {
+		max := math.Inf(-1)
+		for _, v := range values {
+			max = math.Max(max, v)
+		}
+		return max
+	},
+	"count": func(values []float64) float64 {
+		return float64(len(values))
+	},
+}
+
+// aggregateQuery groups the latest readings of the selected apps by a label
+// and combines a field over every group. A field such as
+// FailAmount/AccessAmount is the ratio of the sums of both fields.
+type aggregateQuery struct {
+	by     string
+	field  string
+	agg    string
+	window time.Duration
+	sel    appSelector
+}
+
+func parseAggregateQuery(req *http.Request) (aggregateQuery, error) {
+	q := req.URL.Query()
+	a := aggregateQuery{by: q.Get("by"), field: q.Get("field"), agg: q.Get("agg")}
+	if len(a.by) == 0 {
+		a.by = "domain"
+	}
+	if len(a.field) == 0 {
+		a.field = "AccessAmount"
+	}
+	if len(a.agg) == 0 {
+		a.agg = "sum"
+	}
+	if _, ok := aggregations[a.agg]; !ok {
+		return aggregateQuery{}, fmt.Errorf("unknown aggregation %q, want sum, avg, min, max or count", a.agg)
+	}
+	var err error
+	if a.window, err = parseWindow(req, "window", 5*time.Minute); err != nil {
+		return aggregateQuery{}, err
+	}
+	if a.sel, err = parseAppSelector(q); err != nil {
+		return aggregateQuery{}, err
+	}
+	return a, nil
+}
+
+// String describes the query, e.g. sum(AccessAmount) by domain.
+func (a aggregateQuery) String() string {
+	if num, den, ok := a.ratio(); ok {
+		return fmt.Sprintf("sum(%s) / sum(%s) by %s", num, den, a.by)
+	}
+	return fmt.Sprintf("%s(%s) by %s", a.agg, a.field, a.by)
+}
+
+func (a aggregateQuery) ratio() (num, den string, ok bool) {
+	i := strings.IndexByte(a.field, '/')
+	if i <= 0 || i == len(a.field)-1 {
+		return "", "", false
+	}
+	return a.field[:i], a.field[i+1:], true
+}
+
+// group is an aggregated value of the members sharing a label value.
+type group struct {
+	Group string  `json:"group"`
+	Value float64 `json:"value"`
+	// Members counts the readings combined: the latest sample of every
+	// target and label set, such as every pod behind a service.
+	Members int `json:"members"`
+}
+
+// latestReadings returns the latest sample of every distinct label set of
+// every target since a time.
+func latestReadings(targets []target, s *store, since time.Time) []sample {
+	var readings []sample
+	for _, t := range targets {
+		latest := map[string]int{}
+		for _, smp := range s.samplesSince(t.Name, since) {
+			key := labelSetKey(smp.Labels)
+			if i, ok := latest[key]; ok {
+				readings[i] = smp
+				continue
+			}
+			latest[key] = len(readings)
+			readings = append(readings, smp)
+		}
+	}
+	return readings
+}
+
+func labelSetKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xff")
+}
+
+// aggregate groups readings by a.by and combines a.field over every group,
+// sorted by group. Readings without the label form the group "".
+func (a aggregateQuery) aggregate(readings []sample) []group {
+	num, den, isRatio := a.ratio()
+	values := map[string][]float64{}
+	denominators := map[string][]float64{}
+	members := map[string]int{}
+	for _, r := range readings {
+		g := r.Labels[a.by]
+		if isRatio {
+			n, ok1 := r.Values[num]
+			d, ok2 := r.Values[den]
+			if !ok1 || !ok2 {
+				continue
+			}
+			values[g] = append(values[g], n)
+			denominators[g] = append(denominators[g], d)
+		} else {
+			v, ok := r.Values[a.field]
+			if !ok {
+				continue
+			}
+			values[g] = append(values[g], v)
+		}
+		members[g]++
+	}
+	groups := []group{}
+	for g, vs := range values {
+		var v float64
+		if isRatio {
+			d := aggregations["sum"](denominators[g])
+			if d == 0 {
+				continue
+			}
+			v = aggregations["sum"](vs) / d
+		} else {
+			v = aggregations[a.agg](vs)
+		}
+		groups = append(groups, group{Group: g, Value: v, Members: members[g]})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Group < groups[j].Group })
+	return groups
+}
+
+// run evaluates the query over the stored samples.
+func (a aggregateQuery) run(cfg *config, s *store, now time.Time) []group {
+	return a.aggregate(latestReadings(selectTargets(cfg, s, a.sel), s, now.Add(-a.window)))
+}
+
+// renderGroupChart draws a bar per group.
+func renderGroupChart(w io.Writer, title string, groups []group, opts chartOptions) error {
+	var bars []chart.Value
+	for _, g := range groups {
+		label := g.Group
+		if len(label) == 0 {
+			label = "(none)"
+		}
+		bars = append(bars, chart.Value{Value: g.Value, Label: label})
+	}
+	if len(bars) == 0 {
+		return errors.New("no values to chart")
+	}
+	// Bars start from zero, so groups compare by their height.
+	yrange := &chart.ContinuousRange{}
+	for _, b := range bars {
+		yrange.Min = math.Min(yrange.Min, b.Value)
+		yrange.Max = math.Max(yrange.Max, b.Value)
+	}
+	if yrange.Min == yrange.Max {
+		yrange.Max = yrange.Min + 1
+	}
+	bc := chart.BarChart{
+		Title: title,
+		TitleStyle: chart.Style{
+			Show: true,
+		},
+		Width:    opts.Width,
+		Height:   opts.Height,
+		BarWidth: 60,
+		XAxis: chart.Style{
+			Show: true,
+		},
+		YAxis: chart.YAxis{
+			Style: chart.Style{
+				Show: true,
+			},
+			Range: yrange,
+		},
+		Bars: bars,
+	}
+	return render(w, bc, opts)
+}
+
+// renderGroupChartRequest renders the grouped bar chart of the query of req.
+func renderGroupChartRequest(w io.Writer, req *http.Request, cfg *config, s *store, opts chartOptions) (int, error) {
+	a, err := parseAggregateQuery(req)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := renderGroupChart(w, a.String(), a.run(cfg, s, time.Now()), opts); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// apiAggregate serves the groups of an aggregation query as JSON.
+func apiAggregate(cfg *config, s *store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		a, err := parseAggregateQuery(req)
+		if err != nil {
+			writeJSONError(res, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, struct {
+			Query  string  `json:"query"`
+			Groups []group `json:"groups"`
+		}{a.String(), a.run(cfg, s, time.Now())})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	reading := func(domain, host string, access, fail, latency float64) sample {
+		return sample{
+			Labels: map[string]string{"domain": domain, "host": host},
+			Values: map[string]float64{"AccessAmount": access, "FailAmount": fail, "AvgLatency": latency},
+		}
+	}
+	readings := []sample{
+		reading("shop", "node-1", 100, 10, 40),
+		reading("shop", "node-2", 300, 10, 80),
+		reading("web", "node-1", 50, 0, 20),
+	}
+	for _, c := range []struct {
+		query aggregateQuery
+		want  map[string]float64
+	}{
+		{aggregateQuery{by: "domain", field: "AccessAmount", agg: "sum"}, map[string]float64{"shop": 400, "web": 50}},
+		{aggregateQuery{by: "host", field: "AvgLatency", agg: "max"}, map[string]float64{"node-1": 40, "node-2": 80}},
+		{aggregateQuery{by: "domain", field: "AvgLatency", agg: "avg"}, map[string]float64{"shop": 60, "web": 20}},
+		{aggregateQuery{by: "domain", field: "FailAmount/AccessAmount"}, map[string]float64{"shop": 0.05, "web": 0}},
+	} {
+		groups := c.query.aggregate(readings)
+		if len(groups) != len(c.want) {
+			t.Errorf("%s: got %v, want %v", c.query, groups, c.want)
+			continue
+		}
+		for _, g := range groups {
+			if want, ok := c.want[g.Group]; !ok || math.Abs(g.Value-want) > 1e-9 {
+				t.Errorf("%s: group %q = %v, want %v", c.query, g.Group, g.Value, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// writeJSON answers with v encoded as JSON.
+func writeJSON(res http.ResponseWriter, status int, v interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeJSONError answers with err as a JSON error object.
+func writeJSONError(res http.ResponseWriter, status int, err error) {
+	writeJSON(res, status, map[string]string{"error": err.Error()})
+}
+
+// parseWindow reads a duration query parameter, returning def when it is unset.
+func parseWindow(req *http.Request, name string, def time.Duration) (time.Duration, error) {
+	v := req.URL.Query().Get(name)
+	if len(v) == 0 {
+		return def, nil
+	}
+	d, err := parseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return d, nil
+}
+
+// apiMetric is a value of the latest sample with its description and labels.
+type apiMetric struct {
+	metricDesc
+	Key    string            `json:"key"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// apiMetrics serves the values of the latest sample of a target, each with
+// its type, unit and labels.
+func apiMetrics(cfg *config, s *store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		t, err := cfg.target(req.URL.Query().Get("target"))
+		if err != nil {
+			writeJSONError(res, http.StatusNotFound, err)
+			return
+		}
+		samples := s.samples(t.Name)
+		metrics := []apiMetric{}
+		if len(samples) > 0 {
+			latest := samples[len(samples)-1]
+			for _, key := range valueNames(latest) {
+				_, seriesLabels := splitSeries(key)
+				labels := map[string]string{}
+				for k, v := range latest.Labels {
+					labels[k] = v
+				}
+				for k, v := range seriesLabels {
+					labels[k] = v
+				}
+				metrics = append(metrics, apiMetric{
+					metricDesc: metricDescs.describe(t, key),
+					Key:        key,
+					Labels:     labels,
+					Value:      latest.Values[key],
+				})
+			}
+		}
+		writeJSON(res, http.StatusOK, map[string]interface{}{"target": t.Name, "metrics": metrics})
+	}
+}
+
+// apiSamples serves the stored samples of a target over a window, optionally
+// reduced to a single field.
+func apiSamples(cfg *config, s *store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		t, err := cfg.target(q.Get("target"))
+		if err != nil {
+			writeJSONError(res, http.StatusNotFound, err)
+			return
+		}
+		window, err := parseWindow(req, "window", time.Hour)
+		if err != nil {
+			writeJSONError(res, http.StatusBadRequest, err)
+			return
+		}
+		samples := s.samplesSince(t.Name, time.Now().Add(-window))
+		if field := q.Get("field"); len(field) > 0 {
+			filtered := make([]sample, 0, len(samples))
+			for _, smp := range samples {
+				if v, ok := smp.Values[field]; ok {
+					filtered = append(filtered, sample{Time: smp.Time, Labels: smp.Labels, Values: map[string]float64{field: v}})
+				}
+			}
+			samples = filtered
+		}
+		if samples == nil {
+			samples = []sample{}
+		}
+		writeJSON(res, http.StatusOK, map[string]interface{}{"target": t.Name, "samples": samples})
+	}
+}
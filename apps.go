@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	chart "github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
+)
+
+// labelMatcher matches a label against a value like a Prometheus selector:
+// name="value", name!="value", name=~"regexp" or name!~"regexp". The quotes
+// are optional.
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func parseLabelMatcher(s string) (labelMatcher, error) {
+	i := strings.IndexAny(s, "=!")
+	if i <= 0 {
+		return labelMatcher{}, fmt.Errorf("invalid label matcher %q", s)
+	}
+	for _, op := range []string{"=~", "!~", "!=", "="} {
+		if !strings.HasPrefix(s[i:], op) {
+			continue
+		}
+		value := strings.TrimSpace(s[i+len(op):])
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		m, err := newLabelMatcher(strings.TrimSpace(s[:i]), op, value)
+		if err != nil {
+			return labelMatcher{}, fmt.Errorf("invalid label matcher %q: %v", s, err)
+		}
+		return m, nil
+	}
+	return labelMatcher{}, fmt.Errorf("invalid label matcher %q", s)
+}
+
+func newLabelMatcher(name, op, value string) (labelMatcher, error) {
+	m := labelMatcher{name: name, op: op, value: value}
+	if op == "=~" || op == "!~" {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return labelMatcher{}, err
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// matches reports whether labels satisfy m. A missing label is empty.
+func (m labelMatcher) matches(labels map[string]string) bool {
+	v := labels[m.name]
+	switch m.op {
+	case "=":
+		return v == m.value
+	case "!=":
+		return v != m.value
+	case "=~":
+		return m.re.MatchString(v)
+	}
+	return !m.re.MatchString(v)
+}
+
+func (m labelMatcher) String() string {
+	return m.name + m.op + fmt.Sprintf("%q", m.value)
+}
+
+// appSelector selects targets by app name, domain and label matchers. An
+// empty selector selects every target.
+type appSelector struct {
+	apps     []string
+	domains  []string
+	matchers []labelMatcher
+}
+
+// parseAppSelector reads the app, domain and match parameters. app and domain
+// take comma separated lists and may be repeated; every match must hold.
+func parseAppSelector(q url.Values) (appSelector, error) {
+	var sel appSelector
+	list := func(name string) []string {
+		var values []string
+		for _, v := range q[name] {
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); len(item) > 0 {
+					values = append(values, item)
+				}
+			}
+		}
+		return values
+	}
+	sel.apps = list("app")
+	sel.domains = list("domain")
+	for _, v := range q["match"] {
+		m, err := parseLabelMatcher(v)
+		if err != nil {
+			return appSelector{}, err
+		}
+		sel.matchers = append(sel.matchers, m)
+	}
+	return sel, nil
+}
+
+// selects reports whether the target with the given labels is selected. An
+// app is named by its app label or by the target name.
+func (sel appSelector) selects(t target, labels map[string]string) bool {
+	if len(sel.apps) > 0 && !contains(sel.apps, labels["app"]) && !contains(sel.apps, t.Name) {
+		return false
+	}
+	if len(sel.domains) > 0 && !contains(sel.domains, labels["domain"]) {
+		return false
+	}
+	for _, m := range sel.matchers {
+		if !m.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// targetLabels returns the labels of the latest sample of t, or its static
+// labels before the first scrape, with the target name as the target label.
+func targetLabels(t target, s *store) map[string]string {
+	labels := map[string]string{}
+	for k, v := range t.Labels {
+		labels[k] = v
+	}
+	if smp, ok := s.latest(t.Name); ok {
+		for k, v := range smp.Labels {
+			labels[k] = v
+		}
+	}
+	labels["target"] = t.Name
+	return labels
+}
+
+// selectTargets returns the targets sel selects, in configuration order.
+func selectTargets(cfg *config, s *store, sel appSelector) []target {
+	var targets []target
+	for _, t := range cfg.Targets {
+		if sel.selects(t, targetLabels(t, s)) {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// appName names the app of t for legends and labels.
+func appName(t target, s *store) string {
+	if app := targetLabels(t, s)["app"]; len(app) > 0 && app != t.Name {
+		return app + " (" + t.Name + ")"
+	}
+	return t.Name
+}
+
+// appSeries is the samples of one app.
+type appSeries struct {
+	Name    string
+	Samples []sample
+}
+
+// renderAppsChart draws field over time for several apps on the same axes.
+func renderAppsChart(w io.Writer, field, unit string, apps []appSeries, opts chartOptions) error {
+	var series []chart.Series
+	for _, app := range apps {
+		if ts := fieldSeries(app.Name, field, app.Samples, 0); len(ts.XValues) >= 2 {
+			series = append(series, ts)
+		}
+	}
+	if len(series) == 0 {
+		return errors.New("not enough samples to chart")
+	}
+	c := chart.Chart{
+		Title: field + " by app",
+		TitleStyle: chart.Style{
+			Show: true,
+		},
+		Width:  opts.Width,
+		Height: opts.Height,
+		XAxis: chart.XAxis{
+			Style:          chart.Style{Show: true},
+			ValueFormatter: chart.TimeValueFormatterWithFormat("15:04:05"),
+		},
+		YAxis: chart.YAxis{
+			Name:      axisName(field, unit),
+			NameStyle: chart.Style{Show: true},
+			Style:     chart.Style{Show: true},
+		},
+		Series: series,
+	}
+	c.Elements = []chart.Renderable{chart.Legend(&c)}
+	return render(w, c, opts)
+}
+
+// renderStackedChart draws the share of failed and succeeded requests of the
+// latest sample of every app, failed on top.
+func renderStackedChart(w io.Writer, latest []appSeries, opts chartOptions) error {
+	var bars []chart.StackedBar
+	for _, app := range latest {
+		if len(app.Samples) == 0 {
+			continue
+		}
+		s := app.Samples[len(app.Samples)-1]
+		access, ok1 := s.Values["AccessAmount"]
+		failed, ok2 := s.Values["FailAmount"]
+		if !ok1 || !ok2 || access <= 0 {
+			continue
+		}
+		bars = append(bars, chart.StackedBar{
+			Name: fmt.Sprintf("%s %.1f%%", app.Name, failed/access*100),
+			Values: []chart.Value{
+				{Value: failed, Label: "Failed", Style: chart.Style{FillColor: drawing.ColorFromHex("c62828"), StrokeColor: drawing.ColorFromHex("c62828")}},
+				{Value: access - failed, Label: "Succeeded", Style: chart.Style{FillColor: drawing.ColorFromHex("2e7d32"), StrokeColor: drawing.ColorFromHex("2e7d32")}},
+			},
+		})
+	}
+	if len(bars) == 0 {
+		return errors.New("no app reports AccessAmount and FailAmount")
+	}
+	// The bars span the canvas, leave room for the padding and the y axis.
+	const spacing, padding, yAxisWidth = 40, 20, 60
+	width := (opts.Width-2*padding-yAxisWidth)/len(bars) - spacing
+	if width < 10 {
+		width = 10
+	}
+	for i := range bars {
+		bars[i].Width = width
+	}
+	sbc := chart.StackedBarChart{
+		Title: "Failed (red) and succeeded requests by app",
+		TitleStyle: chart.Style{
+			Show: true,
+		},
+		Width:      opts.Width,
+		Height:     opts.Height,
+		Background: chart.Style{Padding: chart.Box{Top: 60, Left: padding, Right: padding}},
+		BarSpacing: spacing,
+		XAxis:      chart.Style{Show: true},
+		YAxis:      chart.Style{Show: true},
+		Bars:       bars,
+	}
+	return render(w, sbc, opts)
+}
+
+// renderAppsChartRequest renders the charts comparing the apps selected by
+// the query of req and returns the status code to answer with.
+func renderAppsChartRequest(w io.Writer, req *http.Request, cfg *config, s *store, opts chartOptions) (int, error) {
+	q := req.URL.Query()
+	sel, err := parseAppSelector(q)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	targets := selectTargets(cfg, s, sel)
+	if len(targets) == 0 {
+		return http.StatusNotFound, errors.New("no app matches the selection")
+	}
+	switch q.Get("type") {
+	case "apps":
+		field := q.Get("field")
+		if len(field) == 0 {
+			field = "AvgLatency"
+		}
+		window, err := parseWindow(req, "window", time.Hour)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		since := time.Now().Add(-window)
+		var apps []appSeries
+		units := map[string]bool{}
+		var unit string
+		for _, t := range targets {
+			apps = append(apps, appSeries{appName(t, s), s.samplesSince(t.Name, since)})
+			unit = metricDescs.describe(t, field).Unit
+			units[unit] = true
+		}
+		if len(units) > 1 {
+			// Apps disagree on the unit, leave it off the axis.
+			unit = ""
+		}
+		if err := renderAppsChart(w, field, unit, apps, opts); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	case "stacked":
+		var apps []appSeries
+		for _, t := range targets {
+			if smp, ok := s.latest(t.Name); ok {
+				apps = append(apps, appSeries{appName(t, s), []sample{smp}})
+			}
+		}
+		if err := renderStackedChart(w, apps, opts); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestAppSelector(t *testing.T) {
+	targets := []struct {
+		target target
+		labels map[string]string
+	}{
+		{target{Name: "orders"}, map[string]string{"app": "orders", "domain": "shop", "env": "prod"}},
+		{target{Name: "payments-eu"}, map[string]string{"app": "payments", "domain": "shop", "env": "staging"}},
+		{target{Name: "search"}, map[string]string{"app": "search", "domain": "web", "env": "prod"}},
+	}
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"orders", "payments-eu", "search"}},
+		{"app=orders,payments", []string{"orders", "payments-eu"}},
+		{"app=payments-eu", []string{"payments-eu"}},
+		{"domain=shop&match=env=prod", []string{"orders"}},
+		{`match=env!="prod"`, []string{"payments-eu"}},
+		{"match=app=~o.*|s.*", []string{"orders", "search"}},
+		{"match=domain!~sh.*", []string{"search"}},
+	} {
+		q, _ := url.ParseQuery(c.query)
+		sel, err := parseAppSelector(q)
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		var got []string
+		for _, tl := range targets {
+			if sel.selects(tl.target, tl.labels) {
+				got = append(got, tl.target.Name)
+			}
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%q selects %v, want %v", c.query, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%q selects %v, want %v", c.query, got, c.want)
+				break
+			}
+		}
+	}
+
+	for _, bad := range []string{"env", "=prod", "app=~(", "env!prod"} {
+		if _, err := parseLabelMatcher(bad); err == nil {
+			t.Errorf("parseLabelMatcher(%q) should fail", bad)
+		}
+	}
+}
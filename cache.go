@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// renderCache keeps rendered charts until the next scrape could change them,
+// so a dashboard refreshed by many viewers renders each chart once per scrape
+// interval. Concurrent requests for a chart that is being rendered wait for
+// that render instead of starting their own.
+type renderCache struct {
+	mu sync.Mutex
+	// size is the most charts kept; charts being rendered do not count.
+	size    int
+	entries map[string]*renderedChart
+}
+
+// renderedChart is a chart in the cache. Its fields are set once done is
+// closed.
+type renderedChart struct {
+	done     chan struct{}
+	status   int
+	body     []byte
+	etag     string
+	modified time.Time
+	expires  time.Time
+}
+
+func newRenderCache(size int) *renderCache {
+	return &renderCache{size: size, entries: map[string]*renderedChart{}}
+}
+
+// get returns the chart cached under key, or waits for the render of it in
+// progress until ctx is done, or renders it with render. Charts that did not
+// render with status 200 are shared with the requests waiting for them but
+// not kept; a render that panics answers its waiters with status 500.
+func (c *renderCache) get(ctx context.Context, key string, ttl time.Duration, render func() (int, []byte)) (*renderedChart, error) {
+	now := time.Now()
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		select {
+		case <-e.done:
+			if now.Before(e.expires) {
+				c.mu.Unlock()
+				renderCacheRequests.inc("hit")
+				return e, nil
+			}
+		default:
+			c.mu.Unlock()
+			renderCacheRequests.inc("coalesced")
+			select {
+			case <-e.done:
+				return e, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	e := &renderedChart{done: make(chan struct{}), status: http.StatusInternalServerError}
+	c.entries[key] = e
+	c.mu.Unlock()
+	renderCacheRequests.inc("miss")
+
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		close(e.done)
+		if e.status != http.StatusOK || ttl <= 0 {
+			if c.entries[key] == e {
+				delete(c.entries, key)
+			}
+			return
+		}
+		c.evict(e.modified)
+	}()
+	status, body := render()
+	h := fnv.New64a()
+	h.Write(body)
+	e.body = body
+	e.etag = `"` + strconv.FormatUint(h.Sum64(), 16) + `"`
+	e.modified = time.Now()
+	e.expires = e.modified.Add(ttl)
+	e.status = status
+	return e, nil
+}
+
+// evict drops expired charts, then the ones expiring first until at most
+// size charts are kept. c.mu must be held.
+func (c *renderCache) evict(now time.Time) {
+	var kept []string
+	for key, e := range c.entries {
+		select {
+		case <-e.done:
+		default:
+			continue
+		}
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		kept = append(kept, key)
+	}
+	for ; len(kept) > c.size; kept = kept[1:] {
+		first := 0
+		for i, key := range kept {
+			if c.entries[key].expires.Before(c.entries[kept[first]].expires) {
+				first = i
+			}
+		}
+		delete(c.entries, kept[first])
+		kept[first] = kept[0]
+	}
+}
+
+// serve answers req with the chart cached under key, rendering it with
+// render when needed. render must not depend on the context of req, since
+// the chart it renders is shared with other requests. Successful charts
+// carry an ETag and Last-Modified, so browsers revalidate them with a 304
+// until they change.
+func (c *renderCache) serve(res http.ResponseWriter, req *http.Request, key, contentType string, ttl time.Duration, render func() (int, []byte)) {
+	e, err := c.get(req.Context(), key, ttl, render)
+	if err != nil {
+		// The client went away while waiting for the render.
+		return
+	}
+	res.Header().Set("Content-Type", contentType)
+	if e.status != http.StatusOK {
+		res.WriteHeader(e.status)
+		res.Write(e.body)
+		return
+	}
+	maxAge := int(time.Until(e.expires) / time.Second)
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	res.Header().Set("Cache-Control", "max-age="+strconv.Itoa(maxAge))
+	res.Header().Set("ETag", e.etag)
+	http.ServeContent(res, req, "", e.modified, bytes.NewReader(e.body))
+}
+
+// chartKey identifies the chart asked for by req: its path and its query
+// parameters in a canonical order, so the target, chart type, size and time
+// window all tell charts apart.
+func chartKey(req *http.Request) string {
+	return req.URL.Path + "?" + req.URL.Query().Encode()
+}
+
+// shortestScrapeInterval returns the shortest scrape interval of any
+// target, how long charts spanning several targets stay cached.
+func shortestScrapeInterval(cfg *config) time.Duration {
+	d := cfg.ScrapeInterval
+	for _, t := range cfg.Targets {
+		if i := cfg.scrapeInterval(t); i < d {
+			d = i
+		}
+	}
+	return d
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRenderCache(t *testing.T) {
+	c := newRenderCache(2)
+	ctx := context.Background()
+	renders := 0
+	render := func(status int) func() (int, []byte) {
+		return func() (int, []byte) {
+			renders++
+			return status, []byte("chart")
+		}
+	}
+
+	first, _ := c.get(ctx, "a", time.Minute, render(http.StatusOK))
+	if again, _ := c.get(ctx, "a", time.Minute, render(http.StatusOK)); again != first || renders != 1 {
+		t.Errorf("cached chart rendered %d times, want once", renders)
+	}
+	first.expires = time.Now()
+	c.get(ctx, "a", time.Minute, render(http.StatusOK))
+	if renders != 2 {
+		t.Errorf("expired chart rendered %d times, want twice", renders)
+	}
+	c.get(ctx, "failed", time.Minute, render(http.StatusBadGateway))
+	c.get(ctx, "failed", time.Minute, render(http.StatusBadGateway))
+	if renders != 4 {
+		t.Errorf("failed charts rendered %d times, want 4", renders)
+	}
+
+	c.get(ctx, "b", 2*time.Minute, render(http.StatusOK))
+	c.get(ctx, "c", 3*time.Minute, render(http.StatusOK))
+	if _, ok := c.entries["a"]; ok || len(c.entries) != 2 {
+		t.Errorf("cache of size 2 keeps %d charts, want the two expiring last", len(c.entries))
+	}
+
+	// Requests arriving during a render wait for it.
+	started, release := make(chan struct{}), make(chan struct{})
+	renders = 0
+	coalesced := func() float64 {
+		renderCacheRequests.mu.Lock()
+		defer renderCacheRequests.mu.Unlock()
+		return renderCacheRequests.values["coalesced"]
+	}
+	before := coalesced()
+	var wg sync.WaitGroup
+	results := make([]*renderedChart, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = c.get(ctx, "slow", time.Minute, func() (int, []byte) {
+				renders++
+				close(started)
+				<-release
+				return http.StatusOK, []byte("slow chart")
+			})
+		}(i)
+		if i == 0 {
+			<-started
+		}
+	}
+	for coalesced()-before < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	// A waiting request gives up when its client goes away.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.get(cancelled, "slow", time.Minute, render(http.StatusOK)); err != context.Canceled {
+		t.Errorf("cancelled waiter got %v, want %v", err, context.Canceled)
+	}
+	close(release)
+	wg.Wait()
+	if renders != 1 {
+		t.Errorf("concurrent requests rendered %d times, want once", renders)
+	}
+	for _, r := range results {
+		if r != results[0] {
+			t.Errorf("concurrent requests got different charts")
+		}
+	}
+
+	// A panicking render answers its waiters and leaves nothing behind.
+	started, release = make(chan struct{}), make(chan struct{})
+	waiter := make(chan *renderedChart)
+	before = coalesced()
+	go func() {
+		defer func() { recover() }()
+		c.get(ctx, "panic", time.Minute, func() (int, []byte) {
+			close(started)
+			<-release
+			panic("renderer bug")
+		})
+	}()
+	<-started
+	go func() {
+		e, _ := c.get(ctx, "panic", time.Minute, render(http.StatusOK))
+		waiter <- e
+	}()
+	for coalesced() == before {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if e := <-waiter; e.status != http.StatusInternalServerError {
+		t.Errorf("waiter of a panicking render got status %d, want 500", e.status)
+	}
+	if e, _ := c.get(ctx, "panic", time.Minute, render(http.StatusOK)); e.status != http.StatusOK {
+		t.Errorf("render after a panic got status %d, want 200", e.status)
+	}
+}
+
+func TestChartRevalidation(t *testing.T) {
+	cfg := &config{Targets: []target{{Name: "orders"}}, ScrapeInterval: time.Minute}
+	s, _ := newStore(100, "")
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		s.add("orders", sample{
+			Time:   now.Add(time.Duration(i-3) * time.Minute),
+			Labels: map[string]string{"app": "orders"},
+			Values: map[string]float64{"AvgLatency": float64(40 + i)},
+		})
+	}
+	h := drawChart(cfg, s, newRenderCache(10))
+	get := func(query string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path+"?"+query, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		res := httptest.NewRecorder()
+		h(res, req)
+		return res
+	}
+
+	res := get("type=timeseries&target=orders", nil)
+	etag, modified := res.Header().Get("ETag"), res.Header().Get("Last-Modified")
+	if res.Code != http.StatusOK || len(etag) == 0 || len(modified) == 0 || res.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("chart = %d %v", res.Code, res.Header())
+	}
+	if cc := res.Header().Get("Cache-Control"); cc != "max-age=59" && cc != "max-age=60" {
+		t.Errorf("Cache-Control = %q, want the scrape interval", cc)
+	}
+	// The parameter order does not matter.
+	if res := get("target=orders&type=timeseries", nil); res.Header().Get("ETag") != etag || res.Body.Len() == 0 {
+		t.Errorf("reordered parameters got %d %v", res.Code, res.Header())
+	}
+	if res := get("type=timeseries&target=orders", map[string]string{"If-None-Match": etag}); res.Code != http.StatusNotModified || res.Body.Len() != 0 {
+		t.Errorf("If-None-Match answered %d, want 304", res.Code)
+	}
+	if res := get("type=timeseries&target=orders", map[string]string{"If-Modified-Since": modified}); res.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since answered %d, want 304", res.Code)
+	}
+	if res := get("type=timeseries&target=orders", map[string]string{"If-None-Match": `"stale"`}); res.Code != http.StatusOK || res.Body.Len() == 0 {
+		t.Errorf("stale ETag answered %d, want 200", res.Code)
+	}
+	if res := get("type=timeseries&target=orders&width=512", nil); res.Header().Get("ETag") == etag {
+		t.Errorf("charts of different sizes share an ETag")
+	}
+	if res := get("type=nonsense&target=orders", nil); res.Code != http.StatusBadRequest || len(res.Header().Get("ETag")) > 0 {
+		t.Errorf("failed chart = %d %v, want 400 without ETag", res.Code, res.Header())
+	}
+}
+
+func TestChartOutlivesLeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(`{"app_name": "orders", "performance_index": {"accessAmount": 100, "avgLatency": 48, "failAmount": 2}}`))
+	}))
+	defer server.Close()
+	cfg := &config{Targets: []target{{Name: "orders", URL: server.URL, decoder: legacyDecoder{}}}, ScrapeInterval: time.Minute}
+	s, _ := newStore(100, "")
+
+	// The request leading the render is gone already; the scrape of the
+	// chart shared with other requests still succeeds.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", path+"?type=bar&target=orders", nil).WithContext(ctx)
+	res := httptest.NewRecorder()
+	drawChart(cfg, s, newRenderCache(10))(res, req)
+	if res.Code != http.StatusOK {
+		t.Errorf("chart of a cancelled leader answered %d, want 200", res.Code)
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	chart "github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
+)
+
+var path = "/k8s-app-monitor-agent"
+
+const (
+	defaultChartWidth  = 1024
+	defaultChartHeight = 512
+)
+
+// chartFormats maps the supported output formats to their renderers and
+// content types.
+var chartFormats = map[string]struct {
+	provider    chart.RendererProvider
+	contentType string
+}{
+	"png": {chart.PNG, "image/png"},
+	"svg": {chart.SVG, "image/svg+xml"},
+}
+
+// chartOptions are the settings shared by every chart.
+type chartOptions struct {
+	Format string
+	Width  int
+	Height int
+}
+
+func (o chartOptions) provider() (chart.RendererProvider, error) {
+	f, ok := chartFormats[o.Format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported chart format %q", o.Format)
+	}
+	return f.provider, nil
+}
+
+// renderer is a chart that can render itself.
+type renderer interface {
+	Render(rp chart.RendererProvider, w io.Writer) error
+}
+
+// render renders c to w and records the render metrics.
+func render(w io.Writer, c renderer, opts chartOptions) error {
+	provider, err := opts.provider()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	cw := &countingWriter{w: w}
+	err = c.Render(provider, cw)
+	observeRender(opts.Format, start, cw.n)
+	return err
+}
+
+// formatFromFile picks the chart format from the extension of a file name.
+func formatFromFile(name string) (string, error) {
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+	if _, ok := chartFormats[format]; !ok {
+		return "", fmt.Errorf("unsupported chart format %q", format)
+	}
+	return format, nil
+}
+
+// sampleTitle names the app, domain and host a sample comes from.
+func sampleTitle(s sample) string {
+	var lines []string
+	for _, l := range []struct{ title, label string }{{"AppName", "app"}, {"Domain", "domain"}, {"Host", "host"}} {
+		if v, ok := s.Labels[l.label]; ok {
+			lines = append(lines, l.title+":"+v)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// renderBarChart draws the values of s as a bar chart.
+func renderBarChart(w io.Writer, s sample, opts chartOptions) error {
+	var bars []chart.Value
+	for _, name := range valueNames(s) {
+		bars = append(bars, chart.Value{Value: s.Values[name], Label: name})
+	}
+	if len(bars) == 0 {
+		return errors.New("no values to chart")
+	}
+	sbc := chart.BarChart{
+		Title: sampleTitle(s),
+		TitleStyle: chart.Style{
+			Show:                true,
+			TextHorizontalAlign: 1,
+		},
+		Width:    opts.Width,
+		Height:   opts.Height,
+		BarWidth: 60,
+		XAxis: chart.Style{
+			Show: true,
+		},
+		YAxis: chart.YAxis{
+			Style: chart.Style{
+				Show: true,
+			},
+		},
+		Bars: bars,
+	}
+	return render(w, sbc, opts)
+}
+
+// renderPieChart draws the share of succeeded and failed requests of s.
+func renderPieChart(w io.Writer, s sample, opts chartOptions) error {
+	access, ok1 := s.Values["AccessAmount"]
+	failed, ok2 := s.Values["FailAmount"]
+	if !ok1 || !ok2 {
+		return errors.New("the pie chart needs AccessAmount and FailAmount")
+	}
+	succeeded := access - failed
+	if failed+succeeded <= 0 {
+		return errors.New("no requests to chart")
+	}
+	pc := chart.PieChart{
+		Title: sampleTitle(s),
+		TitleStyle: chart.Style{
+			Show: true,
+		},
+		Width:  opts.Width,
+		Height: opts.Height,
+		Values: []chart.Value{
+			{Value: succeeded, Label: "Succeeded"},
+			{Value: failed, Label: "Failed"},
+		},
+	}
+	return render(w, pc, opts)
+}
+
+// renderTimeSeriesChart draws a field of the samples over time.
+func renderTimeSeriesChart(w io.Writer, title, field, unit string, samples []sample, opts chartOptions) error {
+	ts := fieldSeries(field, field, samples, 0)
+	if len(ts.XValues) < 2 {
+		return errors.New("not enough samples to chart")
+	}
+	c := chart.Chart{
+		Title: title,
+		TitleStyle: chart.Style{
+			Show: true,
+		},
+		Width:  opts.Width,
+		Height: opts.Height,
+		XAxis: chart.XAxis{
+			Style:          chart.Style{Show: true},
+			ValueFormatter: chart.TimeValueFormatterWithFormat("15:04:05"),
+		},
+		YAxis: chart.YAxis{
+			Name:      axisName(field, unit),
+			NameStyle: chart.Style{Show: true},
+			Style:     chart.Style{Show: true},
+			Range:     flatRange(ts.YValues),
+		},
+		Series: []chart.Series{ts},
+	}
+	return render(w, c, opts)
+}
+
+// flatRange returns a Y range padded around the value of series all drawing
+// the same constant, which go-chart cannot scale an axis to, or nil to let it
+// scale the axis to the values.
+func flatRange(series ...[]float64) chart.Range {
+	var v float64
+	seen := false
+	for _, values := range series {
+		for _, y := range values {
+			if seen && y != v {
+				return nil
+			}
+			v, seen = y, true
+		}
+	}
+	if !seen {
+		return nil
+	}
+	if v == 0 {
+		return &chart.ContinuousRange{Min: 0, Max: 1}
+	}
+	pad := math.Abs(v) / 10
+	return &chart.ContinuousRange{Min: v - pad, Max: v + pad}
+}
+
+// fieldSeries returns the values of field in samples as a time series, moved
+// forward by shift. The line breaks at samples without values, which mark
+// failed scrapes.
+func fieldSeries(name, field string, samples []sample, shift time.Duration) gappedSeries {
+	ts := gappedSeries{TimeSeries: chart.TimeSeries{Name: name}}
+	for _, s := range samples {
+		n := len(ts.XValues)
+		if len(s.Values) == 0 && n > 0 && (len(ts.breaks) == 0 || ts.breaks[len(ts.breaks)-1] != n) {
+			ts.breaks = append(ts.breaks, n)
+		}
+		if v, ok := s.Values[field]; ok {
+			ts.XValues = append(ts.XValues, s.Time.Add(shift))
+			ts.YValues = append(ts.YValues, v)
+		}
+	}
+	return ts
+}
+
+// gappedSeries is a time series whose line is drawn in segments, leaving
+// gaps before the indexes in breaks.
+type gappedSeries struct {
+	chart.TimeSeries
+	breaks []int
+}
+
+func (s gappedSeries) Render(r chart.Renderer, canvasBox chart.Box, xrange, yrange chart.Range, defaults chart.Style) {
+	style := s.Style.InheritFrom(defaults)
+	from := 0
+	for _, to := range append(s.breaks, len(s.XValues)) {
+		if to > from {
+			segment := chart.TimeSeries{XValues: s.XValues[from:to], YValues: s.YValues[from:to]}
+			chart.Draw.LineSeries(r, canvasBox, xrange, yrange, style, segment)
+		}
+		from = to
+	}
+}
+
+// renderComparisonChart draws field over the current window and, shifted onto
+// it, over the window shift earlier, titled with the change of the mean.
+func renderComparisonChart(w io.Writer, title, field, unit string, current, previous []sample, shift string, opts chartOptions) error {
+	d, err := parseDuration(shift)
+	if err != nil {
+		return err
+	}
+	cur := fieldSeries(field+" now", field, current, 0)
+	cur.Style = chart.Style{Show: true, StrokeColor: chart.ColorBlue, StrokeWidth: 2}
+	prev := fieldSeries(field+" "+shift+" ago", field, previous, d)
+	prev.Style = chart.Style{Show: true, StrokeColor: chart.ColorAlternateGray, StrokeWidth: 2, StrokeDashArray: []float64{5, 5}}
+	if len(cur.XValues) < 2 {
+		return errors.New("not enough samples to chart")
+	}
+	series, values := []chart.Series{cur}, [][]float64{cur.YValues}
+	if len(prev.XValues) < 2 {
+		title += ": no samples " + shift + " ago"
+	} else {
+		series, values = append(series, prev), append(values, prev.YValues)
+		if delta, ok := percentDelta(mean(cur.YValues), mean(prev.YValues)); ok {
+			title += fmt.Sprintf(": %+.1f%% vs %s ago", delta, shift)
+		}
+	}
+	c := chart.Chart{
+		Title: title,
+		TitleStyle: chart.Style{
+			Show: true,
+		},
+		Width:  opts.Width,
+		Height: opts.Height,
+		XAxis: chart.XAxis{
+			Style:          chart.Style{Show: true},
+			ValueFormatter: chart.TimeValueFormatterWithFormat("15:04:05"),
+		},
+		YAxis: chart.YAxis{
+			Name:      axisName(field, unit),
+			NameStyle: chart.Style{Show: true},
+			Style:     chart.Style{Show: true},
+			Range:     flatRange(values...),
+		},
+		Series: series,
+	}
+	c.Elements = []chart.Renderable{chart.Legend(&c)}
+	return render(w, c, opts)
+}
+
+func mean(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// percentDelta returns the change from prev to cur in percent of prev.
+func percentDelta(cur, prev float64) (float64, bool) {
+	if prev == 0 {
+		return 0, false
+	}
+	return (cur - prev) / math.Abs(prev) * 100, true
+}
+
+// axisName labels an axis with a field and its unit.
+func axisName(field, unit string) string {
+	if len(unit) == 0 {
+		return field
+	}
+	return field + " (" + unit + ")"
+}
+
+// errorChart is a placeholder image carrying an error message, so a broken
+// chart still shows why in the browser.
+type errorChart struct {
+	Message string
+	Width   int
+	Height  int
+}
+
+func (e errorChart) Render(rp chart.RendererProvider, w io.Writer) error {
+	r, err := rp(e.Width, e.Height)
+	if err != nil {
+		return err
+	}
+	font, err := chart.GetDefaultFont()
+	if err != nil {
+		return err
+	}
+	chart.Draw.Box(r, chart.Box{Right: e.Width, Bottom: e.Height}, chart.Style{
+		FillColor:   drawing.ColorFromHex("fdf2f2"),
+		StrokeColor: drawing.ColorFromHex("c0392b"),
+		StrokeWidth: 4,
+	})
+	chart.Draw.TextWithin(r, e.Message, chart.Box{Top: e.Height / 3, Left: 40, Right: e.Width - 40, Bottom: e.Height - 40}, chart.Style{
+		Font:                font,
+		FontSize:            14,
+		FontColor:           drawing.ColorFromHex("c0392b"),
+		TextHorizontalAlign: chart.TextHorizontalAlignCenter,
+		TextWrap:            chart.TextWrapWord,
+	})
+	return r.Save(w)
+}
+
+// renderErrorChart draws a placeholder image showing err.
+func renderErrorChart(w io.Writer, err error, opts chartOptions) error {
+	return render(w, errorChart{Message: err.Error(), Width: opts.Width, Height: opts.Height}, opts)
+}
+
+// parseChartOptions reads the format, width and height query parameters.
+func parseChartOptions(req *http.Request) (chartOptions, error) {
+	q := req.URL.Query()
+	opts := chartOptions{Format: q.Get("format"), Width: defaultChartWidth, Height: defaultChartHeight}
+	if len(opts.Format) == 0 {
+		opts.Format = "png"
+	}
+	if _, ok := chartFormats[opts.Format]; !ok {
+		return opts, fmt.Errorf("unsupported chart format %q", opts.Format)
+	}
+	for _, p := range []struct {
+		name  string
+		value *int
+	}{{"width", &opts.Width}, {"height", &opts.Height}} {
+		s := q.Get(p.name)
+		if len(s) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 64 || n > 4096 {
+			return opts, fmt.Errorf("invalid %s %q", p.name, s)
+		}
+		*p.value = n
+	}
+	return opts, nil
+}
+
+// drawChart serves the charts of the target named by the target parameter,
+// the first one by default. The type parameter selects a bar or pie chart of
+// a fresh scrape, or a time series of a field from the store. Charts are
+// cached for the scrape interval of their target.
+func drawChart(cfg *config, s *store, charts *renderCache) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		opts, err := parseChartOptions(req)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		chartType := req.URL.Query().Get("type")
+		ttl := shortestScrapeInterval(cfg)
+		var t target
+		switch chartType {
+		case "apps", "stacked", "group", "query":
+		default:
+			if t, err = cfg.target(req.URL.Query().Get("target")); err != nil {
+				http.Error(res, err.Error(), http.StatusNotFound)
+				return
+			}
+			ttl = cfg.scrapeInterval(t)
+		}
+		charts.serve(res, req, chartKey(req), chartFormats[opts.Format].contentType, ttl, func() (int, []byte) {
+			l := requestLogger(req)
+			var buf bytes.Buffer
+			var status int
+			var err error
+			switch chartType {
+			case "apps", "stacked":
+				status, err = renderAppsChartRequest(&buf, req, cfg, s, opts)
+			case "group":
+				status, err = renderGroupChartRequest(&buf, req, cfg, s, opts)
+			case "query":
+				status, err = renderQueryChartRequest(&buf, req, newQueryEngine(cfg, s), opts)
+			default:
+				l = l.With("target", t.Name)
+				// The chart is shared with the requests coalesced with req, so
+				// its scrape must not end when req is cancelled.
+				ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), cfg.scrapeTimeout(t))
+				defer cancel()
+				retention := time.Duration(s.capacity) * cfg.scrapeInterval(t)
+				status, err = renderChartRequest(&buf, req.WithContext(ctx), t, s, retention, opts)
+			}
+			if err != nil {
+				l.Error("drawing chart failed", "error", err)
+				buf.Reset()
+				if err := renderErrorChart(&buf, err, opts); err != nil {
+					l.Error("rendering error chart failed", "error", err)
+				}
+			}
+			return status, buf.Bytes()
+		})
+	}
+}
+
+// renderChartRequest renders the chart asked for by the query of req and
+// returns the status code to answer with. retention is how far back the
+// samples of t in s reach.
+func renderChartRequest(w io.Writer, req *http.Request, t target, s *store, retention time.Duration, opts chartOptions) (int, error) {
+	q := req.URL.Query()
+	switch chartType := q.Get("type"); chartType {
+	case "", "bar", "pie":
+		var smp sample
+		var err error
+		if t.Push {
+			if smp, err = latestPushed(t, s); err != nil {
+				return http.StatusNotFound, err
+			}
+		} else if smp, err = scrapeTarget(req.Context(), http.DefaultClient, t); err != nil {
+			return http.StatusBadGateway, fmt.Errorf("fetching metric failed: %v", err)
+		}
+		if chartType == "pie" {
+			err = renderPieChart(w, smp, opts)
+		} else {
+			err = renderBarChart(w, smp, opts)
+		}
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	case "timeseries":
+		field := q.Get("field")
+		if len(field) == 0 {
+			field = "AvgLatency"
+		}
+		window, err := parseWindow(req, "window", time.Hour)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		now := time.Now()
+		samples := s.samplesSince(t.Name, now.Add(-window))
+		unit := metricDescs.describe(t, field).Unit
+		if shift := q.Get("compare"); len(shift) > 0 {
+			d, err := parseWindow(req, "compare", 0)
+			if err != nil {
+				return http.StatusBadRequest, err
+			}
+			if window+d > retention {
+				return http.StatusBadRequest, fmt.Errorf("comparing the last %v with %v ago needs %v of samples, STORAGE_CAPACITY keeps %v", window, shift, window+d, retention)
+			}
+			previous := s.samplesBetween(t.Name, now.Add(-window-d), now.Add(-d))
+			err = renderComparisonChart(w, t.Name+" "+field, field, unit, samples, previous, shift, opts)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			break
+		}
+		if err := renderTimeSeriesChart(w, t.Name+" "+field, field, unit, samples, opts); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	case "histogram":
+		field := q.Get("field")
+		if len(field) == 0 {
+			field = "AvgLatency"
+		}
+		window, err := parseWindow(req, "window", time.Hour)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		d := fieldDistribution(t, field, s.samplesSince(t.Name, time.Now().Add(-window)))
+		if err := renderHistogramChart(w, t.Name+" "+field, d, opts); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	default:
+		return http.StatusBadRequest, fmt.Errorf("unknown chart type %q", chartType)
+	}
+	return http.StatusOK, nil
+}
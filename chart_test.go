@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metric "github.com/rootsongjc/k8s-app-monitor-test/service"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// maxPixelDiff is the share of pixels allowed to differ between a rendered
+// PNG and its golden file, to absorb anti-aliasing changes.
+const maxPixelDiff = 0.001
+
+func TestMain(m *testing.M) {
+	// Time axis labels are formatted in the local time zone.
+	time.Local = time.UTC
+	flag.Parse()
+	os.Exit(m.Run())
+}
+
+var fixtureSample = sampleFromMetric(metric.Metric{
+	PerformanceIndex: metric.PerformanceIndex{
+		FailRatio:     0.25,
+		FailAmount:    20,
+		AccessAmount:  80,
+		MaxConcurrent: 35,
+		MinLatency:    12,
+		AvgLatency:    48,
+	},
+	Host:    "node-1",
+	AppName: "test-app",
+	Domain:  "test-domain",
+})
+
+func fixtureSamples() []sample {
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	latencies := []float64{40, 42, 45, 61, 87, 66, 50, 44, 41, 43, 47, 52}
+	samples := make([]sample, len(latencies))
+	for i, latency := range latencies {
+		samples[i] = sample{
+			Time:   start.Add(time.Duration(i) * 15 * time.Second),
+			Labels: fixtureSample.Labels,
+			Values: map[string]float64{"AvgLatency": float64(latency)},
+		}
+	}
+	return samples
+}
+
+func TestChartGolden(t *testing.T) {
+	charts := []struct {
+		name   string
+		render func(io.Writer, chartOptions) error
+	}{
+		{"bar", func(w io.Writer, opts chartOptions) error {
+			return renderBarChart(w, fixtureSample, opts)
+		}},
+		{"timeseries", func(w io.Writer, opts chartOptions) error {
+			return renderTimeSeriesChart(w, "test-app AvgLatency", "AvgLatency", "ms", fixtureSamples(), opts)
+		}},
+		{"gaps", func(w io.Writer, opts chartOptions) error {
+			samples := fixtureSamples()
+			for _, i := range []int{4, 5, 9} {
+				samples[i].Values = map[string]float64{}
+			}
+			return renderTimeSeriesChart(w, "test-app AvgLatency", "AvgLatency", "ms", samples, opts)
+		}},
+		{"flat", func(w io.Writer, opts chartOptions) error {
+			samples := fixtureSamples()
+			for i := range samples {
+				samples[i].Values = map[string]float64{"FailAmount": 0}
+			}
+			return renderTimeSeriesChart(w, "test-app FailAmount", "FailAmount", "", samples, opts)
+		}},
+		{"compare", func(w io.Writer, opts chartOptions) error {
+			previous := fixtureSamples()
+			for i := range previous {
+				previous[i].Time = previous[i].Time.Add(-24 * time.Hour)
+				previous[i].Values = map[string]float64{"AvgLatency": previous[i].Values["AvgLatency"] * 0.8}
+			}
+			return renderComparisonChart(w, "test-app AvgLatency", "AvgLatency", "ms", fixtureSamples(), previous, "1d", opts)
+		}},
+		{"apps", func(w io.Writer, opts chartOptions) error {
+			other := fixtureSamples()
+			for i := range other {
+				other[i].Values = map[string]float64{"AvgLatency": other[i].Values["AvgLatency"]*0.5 + 10}
+			}
+			return renderAppsChart(w, "AvgLatency", "ms", []appSeries{{"test-app", fixtureSamples()}, {"other-app", other}}, opts)
+		}},
+		{"stacked", func(w io.Writer, opts chartOptions) error {
+			other := sample{Values: map[string]float64{"AccessAmount": 200, "FailAmount": 10}}
+			return renderStackedChart(w, []appSeries{{"test-app", []sample{fixtureSample}}, {"other-app", []sample{other}}}, opts)
+		}},
+		{"group", func(w io.Writer, opts chartOptions) error {
+			groups := []group{{Group: "shop", Value: 400}, {Group: "web", Value: 50}, {Group: "", Value: 120}}
+			return renderGroupChart(w, "sum(AccessAmount) by domain", groups, opts)
+		}},
+		{"query", func(w io.Writer, opts chartOptions) error {
+			var result []querySeries
+			var steps []time.Time
+			for _, smp := range fixtureSamples() {
+				steps = append(steps, smp.Time)
+			}
+			for i, app := range []string{"test-app", "other-app"} {
+				qs := querySeries{Name: seriesName("", map[string]string{"app": app})}
+				for _, smp := range fixtureSamples() {
+					qs.Points = append(qs.Points, queryPoint{smp.Time, smp.Values["AvgLatency"] / float64(i+1)})
+				}
+				result = append(result, qs)
+			}
+			return renderQueryChart(w, `avg_over_time(AvgLatency[1m])`, result, steps, opts)
+		}},
+		{"query-flat", func(w io.Writer, opts chartOptions) error {
+			qs := querySeries{Name: seriesName("up", map[string]string{"target": "test-app"})}
+			var steps []time.Time
+			for _, smp := range fixtureSamples() {
+				qs.Points = append(qs.Points, queryPoint{smp.Time, 1})
+				steps = append(steps, smp.Time)
+			}
+			return renderQueryChart(w, "up", []querySeries{qs}, steps, opts)
+		}},
+		{"histogram", func(w io.Writer, opts chartOptions) error {
+			return renderHistogramChart(w, "test-app AvgLatency", sampleDistribution("AvgLatency", fixtureSamples()), opts)
+		}},
+		{"histogram-flat", func(w io.Writer, opts chartOptions) error {
+			samples := fixtureSamples()
+			for i := range samples {
+				samples[i].Values = map[string]float64{"AvgLatency": 48}
+			}
+			return renderHistogramChart(w, "test-app AvgLatency", sampleDistribution("AvgLatency", samples), opts)
+		}},
+		{"pie", func(w io.Writer, opts chartOptions) error {
+			return renderPieChart(w, fixtureSample, opts)
+		}},
+		{"error", func(w io.Writer, opts chartOptions) error {
+			return renderErrorChart(w, errors.New("fetching metric failed: connection refused"), opts)
+		}},
+	}
+	for _, c := range charts {
+		for _, format := range []string{"png", "svg"} {
+			name := c.name + "." + format
+			t.Run(name, func(t *testing.T) {
+				var buf bytes.Buffer
+				opts := chartOptions{Format: format, Width: defaultChartWidth, Height: defaultChartHeight}
+				if err := c.render(&buf, opts); err != nil {
+					t.Fatalf("render: %v", err)
+				}
+				golden := filepath.Join("testdata", "golden", name)
+				if *update {
+					if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				want, err := ioutil.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("%v, run the tests with -update to create it", err)
+				}
+				if format == "png" {
+					comparePNG(t, buf.Bytes(), want)
+				} else if !bytes.Equal(buf.Bytes(), want) {
+					t.Errorf("output differs from %s, run the tests with -update if the change is intended", golden)
+				}
+			})
+		}
+	}
+}
+
+// comparePNG fails t when more than maxPixelDiff of the pixels of got and
+// want differ noticeably.
+func comparePNG(t *testing.T, got, want []byte) {
+	gotImg, err := png.Decode(bytes.NewReader(got))
+	if err != nil {
+		t.Fatalf("decode output: %v", err)
+	}
+	wantImg, err := png.Decode(bytes.NewReader(want))
+	if err != nil {
+		t.Fatalf("decode golden: %v", err)
+	}
+	if gotImg.Bounds() != wantImg.Bounds() {
+		t.Fatalf("size is %v, want %v", gotImg.Bounds(), wantImg.Bounds())
+	}
+	b := gotImg.Bounds()
+	diff := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !similarPixel(gotImg, wantImg, x, y) {
+				diff++
+			}
+		}
+	}
+	if ratio := float64(diff) / float64(b.Dx()*b.Dy()); ratio > maxPixelDiff {
+		t.Errorf("%.2f%% of the pixels differ, run the tests with -update if the change is intended", ratio*100)
+	}
+}
+
+func similarPixel(a, b image.Image, x, y int) bool {
+	const tolerance = 8 << 8
+	r1, g1, b1, a1 := a.At(x, y).RGBA()
+	r2, g2, b2, a2 := b.At(x, y).RGBA()
+	for _, d := range []int64{int64(r1) - int64(r2), int64(g1) - int64(g2), int64(b1) - int64(b2), int64(a1) - int64(a2)} {
+		if d > tolerance || d < -tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+func TestChartCompare(t *testing.T) {
+	cfg := &config{Targets: []target{{Name: "orders"}}, ScrapeInterval: 15 * time.Minute}
+	s, _ := newStore(200, "")
+	now := time.Now()
+	for _, start := range []time.Time{now.Add(-25 * time.Hour), now.Add(-time.Hour)} {
+		for i := 0; i < 4; i++ {
+			s.add("orders", sample{
+				Time:   start.Add(time.Duration(i) * 15 * time.Minute),
+				Labels: map[string]string{"app": "orders"},
+				Values: map[string]float64{"AvgLatency": float64(40 + i)},
+			})
+		}
+	}
+	get := func(query string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		drawChart(cfg, s, newRenderCache(10))(res, httptest.NewRequest("GET", path+"?"+query, nil))
+		return res
+	}
+	if res := get("type=timeseries&target=orders&compare=1d"); res.Code != http.StatusOK || res.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("compare=1d answered %d %v, want a chart", res.Code, res.Header())
+	}
+	// 200 samples at 15m reach back 50h.
+	if res := get("type=timeseries&target=orders&compare=2d&window=3h"); res.Code != http.StatusBadRequest {
+		t.Errorf("compare beyond the stored history answered %d, want 400", res.Code)
+	}
+}
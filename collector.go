@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// collector scrapes every target on its scrape interval and keeps the
+// results in the store. The scrapes of a target are spread over its interval
+// by a fixed offset, and at most ScrapeConcurrency run at once.
+type collector struct {
+	cfg       *config
+	store     *store
+	client    *http.Client
+	exporters []exporter
+
+	// slots holds a token per running scrape.
+	slots chan struct{}
+
+	// firstRound is closed once every target has been scraped once.
+	firstRound chan struct{}
+	wg         sync.WaitGroup
+
+	mu sync.Mutex
+	// pushed holds the time of the last push of every push target that is
+	// not stale.
+	pushed map[string]time.Time
+	health map[string]targetHealth
+}
+
+func newCollector(cfg *config, s *store, exporters []exporter) *collector {
+	slots := cfg.ScrapeConcurrency
+	if slots <= 0 {
+		slots = 1
+	}
+	c := &collector{
+		cfg:   cfg,
+		store: s,
+		// Scrapes time out through their context.
+		client:     &http.Client{},
+		exporters:  exporters,
+		slots:      make(chan struct{}, slots),
+		firstRound: make(chan struct{}),
+		pushed:     map[string]time.Time{},
+		health:     map[string]targetHealth{},
+	}
+	for _, t := range cfg.Targets {
+		c.health[t.Name] = targetHealth{Health: healthUnknown}
+	}
+	return c
+}
+
+// start launches one scrape loop per target, or a staleness loop for push
+// targets. The loops exit when ctx is done.
+func (c *collector) start(ctx context.Context) {
+	var round sync.WaitGroup
+	round.Add(len(c.cfg.Targets))
+	for _, t := range c.cfg.Targets {
+		c.wg.Add(1)
+		if t.Push {
+			// A stored sample with values is a push that is not stale yet.
+			if last, ok := c.store.latest(t.Name); ok && len(last.Values) > 0 {
+				c.pushed[t.Name] = last.Time
+				c.updateHealth(t.Name, last.Time, 0, nil)
+			}
+			round.Done()
+			go c.watch(ctx, t)
+			continue
+		}
+		go c.loop(ctx, t, round.Done)
+	}
+	go func() {
+		round.Wait()
+		close(c.firstRound)
+	}()
+}
+
+// stop waits for the scrape loops to exit after their context is cancelled.
+func (c *collector) stop() {
+	c.wg.Wait()
+}
+
+// loop scrapes t right away, so the first round finishes quickly, then at
+// its offset into every interval. A scrape runs in the background; when the
+// previous one is still running, waiting for a slot or for the target, the
+// next is skipped.
+func (c *collector) loop(ctx context.Context, t target, roundDone func()) {
+	defer c.wg.Done()
+	l := logger.With("target", t.Name, "url", redactURL(t.URL))
+	failures := &failureLimiter{interval: c.cfg.ScrapeErrorLogInterval}
+	interval := c.cfg.scrapeInterval(t)
+	offset := scrapeOffset(t.Name, interval)
+	running := make(chan struct{}, 1)
+	run := func(done func()) {
+		select {
+		case running <- struct{}{}:
+		default:
+			scrapesSkipped.inc(t.Name)
+			l.Debug("scrape skipped, the previous one is still running", "interval", interval.String())
+			return
+		}
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			defer func() { <-running }()
+			if done != nil {
+				defer done()
+			}
+			select {
+			case c.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-c.slots }()
+			c.scrape(ctx, t, l, failures)
+		}()
+	}
+
+	run(roundDone)
+	timer := time.NewTimer(time.Until(nextScrape(time.Now(), interval, offset)))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		run(nil)
+		timer.Reset(time.Until(nextScrape(time.Now(), interval, offset)))
+	}
+}
+
+// scrapeOffset returns the offset into every interval at which the target
+// named name is scraped. It is derived from the name, so it stays the same
+// across restarts while different targets spread over the interval.
+func scrapeOffset(name string, interval time.Duration) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+// nextScrape returns the first time after now at offset into an interval.
+func nextScrape(now time.Time, interval, offset time.Duration) time.Time {
+	next := now.Truncate(interval).Add(offset)
+	if !next.After(now) {
+		next = next.Add(interval)
+	}
+	return next
+}
+
+func (c *collector) scrape(ctx context.Context, t target, l *slog.Logger, failures *failureLimiter) {
+	start := time.Now()
+	sctx, cancel := context.WithTimeout(ctx, c.cfg.scrapeTimeout(t))
+	smp, err := scrapeTarget(sctx, c.client, t)
+	cancel()
+	duration := time.Since(start)
+	scrapeDuration.observe(duration.Seconds(), t.Name)
+	c.updateHealth(t.Name, start, duration, err)
+	if err != nil {
+		class := scrapeErrorClass(err)
+		scrapesTotal.inc(t.Name, "failure")
+		scrapeFailures.inc(t.Name, class)
+		failures.failure(l.With("class", class, "duration_seconds", duration.Seconds()), err)
+		if ctx.Err() == nil {
+			c.storeMarker(t, start)
+		}
+		return
+	}
+	scrapesTotal.inc(t.Name, "success")
+	failures.success(l)
+	l.Debug("scrape succeeded", "duration_seconds", duration.Seconds())
+	c.record(t, smp)
+}
+
+// record derives the computed values of a scraped or pushed sample of t,
+// stores it and hands it to the exporters.
+func (c *collector) record(t target, smp sample) {
+	d := c.cfg.deriver(t)
+	history := c.store.samplesSince(t.Name, smp.Time.Add(-d.maxWindow()))
+	if len(history) == 0 {
+		if last, ok := c.store.latest(t.Name); ok {
+			history = []sample{last}
+		}
+	}
+	smp, descs := d.derive(t, history, smp)
+	metricDescs.update(t.Name, descs)
+	smp = c.store.add(t.Name, smp)
+	for _, e := range c.exporters {
+		e.export(t, smp)
+	}
+}
+
+// push records a sample pushed to t.
+func (c *collector) push(t target, smp sample) {
+	c.mu.Lock()
+	c.pushed[t.Name] = smp.Time
+	c.mu.Unlock()
+	c.updateHealth(t.Name, smp.Time, 0, nil)
+	pushedSamples.inc(t.Name)
+	c.record(t, smp)
+}
+
+// watch marks the push target t stale once nothing was pushed to it for its
+// stale_after.
+func (c *collector) watch(ctx context.Context, t target) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.cfg.ScrapeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.markStale(t, now)
+		}
+	}
+}
+
+// markStale marks t down and stores a marker if the last push to t is older
+// than its stale_after. Charts and queries then show no values instead of
+// the last pushed ones.
+func (c *collector) markStale(t target, now time.Time) {
+	c.mu.Lock()
+	last, ok := c.pushed[t.Name]
+	if !ok || now.Sub(last) < t.staleAfter {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.pushed, t.Name)
+	c.mu.Unlock()
+	c.updateHealth(t.Name, now, 0, fmt.Errorf("stale, nothing pushed since %s", last.Format(time.RFC3339)))
+	c.storeMarker(t, now)
+	logger.Info("push target went stale", "target", t.Name, "last_push", last)
+}
+
+// statusError is returned for a non-200 response from a target.
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", int(e), http.StatusText(int(e)))
+}
+
+// scrapeTarget gets the payload of t and decodes it into a sample carrying
+// the scrape time and the target labels.
+func scrapeTarget(ctx context.Context, client *http.Client, t target) (sample, error) {
+	if t.Push {
+		return sample{}, fmt.Errorf("target %s is pushed to, not scraped", t.Name)
+	}
+	req, err := http.NewRequest("GET", t.URL, nil)
+	if err != nil {
+		return sample{}, err
+	}
+	// A scrape for a chart carries the ID of the request asking for it.
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		req.Header.Set(requestIDHeader, id)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return sample{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return sample{}, statusError(resp.StatusCode)
+	}
+	smp, descs, err := t.decoder.decode(resp.Body)
+	if err != nil {
+		return sample{}, err
+	}
+	metricDescs.update(t.Name, descs)
+	return stampSample(t, smp, time.Now()), nil
+}
+
+// stampSample sets the time of a decoded sample of t and adds the target
+// labels. The app label defaults to the target name.
+func stampSample(t target, smp sample, now time.Time) sample {
+	smp.Time = now
+	for name, value := range t.Labels {
+		smp.Labels[name] = value
+	}
+	if len(smp.Labels["app"]) == 0 {
+		smp.Labels["app"] = t.Name
+	}
+	return smp
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScrapeSchedule(t *testing.T) {
+	interval := 15 * time.Second
+	offsets := map[time.Duration]bool{}
+	for _, name := range []string{"orders", "search", "billing", "test"} {
+		offset := scrapeOffset(name, interval)
+		if offset < 0 || offset >= interval || offset != scrapeOffset(name, interval) {
+			t.Errorf("offset of %s = %v, want a fixed offset within %v", name, offset, interval)
+		}
+		offsets[offset] = true
+	}
+	if len(offsets) < 2 {
+		t.Errorf("every target is scraped at the same offset %v", offsets)
+	}
+
+	now := time.Date(2018, 1, 1, 12, 0, 7, 0, time.UTC)
+	for _, c := range []struct {
+		offset time.Duration
+		want   time.Time
+	}{
+		{10 * time.Second, now.Add(3 * time.Second)},
+		{7 * time.Second, now.Add(interval)},
+		{2 * time.Second, now.Add(10 * time.Second)},
+	} {
+		if got := nextScrape(now, interval, c.offset); !got.Equal(c.want) {
+			t.Errorf("next scrape at offset %v = %v, want %v", c.offset, got, c.want)
+		}
+	}
+}
+
+func TestScrapeConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	arrived, release := make(chan struct{}, 10), make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+		select {
+		case arrived <- struct{}{}:
+		default:
+		}
+		select {
+		case <-release:
+		case <-req.Context().Done():
+			return
+		}
+		res.Write([]byte(`{"performance_index": {"avgLatency": 48}}`))
+	}))
+	defer slow.Close()
+
+	hanging := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer hanging.Close()
+
+	skipped := func(name string) float64 {
+		scrapesSkipped.mu.Lock()
+		defer scrapesSkipped.mu.Unlock()
+		return scrapesSkipped.values[name]
+	}
+	eventually := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	cfg := &config{ScrapeInterval: 10 * time.Millisecond, ScrapeTimeout: time.Minute, ScrapeConcurrency: 1, ScrapeErrorLogInterval: time.Minute}
+	for _, name := range []string{"slow-a", "slow-b"} {
+		cfg.Targets = append(cfg.Targets, target{Name: name, URL: slow.URL, decoder: legacyDecoder{}})
+	}
+	cfg.Targets = append(cfg.Targets, target{Name: "timeout", URL: hanging.URL, decoder: legacyDecoder{}, interval: 50 * time.Millisecond, timeout: 5 * time.Millisecond})
+	before := map[string]float64{"slow-a": skipped("slow-a"), "slow-b": skipped("slow-b")}
+	s, _ := newStore(100, "")
+	c := newCollector(cfg, s, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		c.stop()
+	}()
+	c.start(ctx)
+
+	// While the first slow scrape holds the only slot, the other targets
+	// wait for it and both slow targets skip their next scrapes.
+	<-arrived
+	eventually("skipped scrapes", func() bool {
+		return skipped("slow-a") > before["slow-a"] && skipped("slow-b") > before["slow-b"]
+	})
+	select {
+	case <-arrived:
+		t.Error("a second scrape started while the only slot was taken")
+	default:
+	}
+
+	close(release)
+	eventually("samples of both slow targets", func() bool {
+		return len(s.samples("slow-a")) > 0 && len(s.samples("slow-b")) > 0
+	})
+	eventually("the timeout target to go down", func() bool {
+		return c.targetHealth("timeout").Health == healthDown
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if maxInFlight != 1 {
+		t.Errorf("%d scrapes ran at once, want at most 1", maxInFlight)
+	}
+	if h := c.targetHealth("timeout"); h.LastScrapeDuration > 0.5 {
+		t.Errorf("health of a target timing out after 5ms = %+v", h)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the agent settings read from the environment and, for the
+// targets, from the optional CONFIG_FILE.
+type config struct {
+	Targets        []target
+	ScrapeInterval time.Duration
+	// ScrapeTimeout defaults to the scrape interval of each target.
+	ScrapeTimeout time.Duration
+	// ScrapeConcurrency caps the scrapes running at once across targets.
+	ScrapeConcurrency      int
+	ScrapeErrorLogInterval time.Duration
+	// ShutdownDelay is how long the agent keeps serving, unready, before it
+	// shuts down, so load balancers stop sending it requests first.
+	ShutdownDelay   time.Duration
+	ShutdownTimeout time.Duration
+	StoragePath     string
+	StorageCapacity int
+	// RenderCacheSize is the most rendered charts kept.
+	RenderCacheSize int
+	// PushToken, when set, is the bearer token push requests must carry.
+	PushToken string
+	// SLOTarget is the share of requests that should succeed, used for the
+	// burn rates of targets that do not set their own.
+	SLOTarget       float64
+	BurnRateWindows []time.Duration
+	RemoteWrite     remoteWriteConfig
+	OTLP            otlpConfig
+	Sinks           []sinkConfig
+}
+
+// target is an application endpoint the agent scrapes, or an app pushing
+// its metrics to the agent.
+type target struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Decoder reads the payload: legacy (the default) for metric.Metric
+	// JSON, prometheus for the text exposition format, or json.
+	Decoder string `json:"decoder,omitempty"`
+	// Fields and LabelPaths map value and label names to JSONPath-style
+	// paths into the payload for the json decoder.
+	Fields     map[string]string `json:"fields,omitempty"`
+	LabelPaths map[string]string `json:"label_paths,omitempty"`
+	// Labels are added to every sample of the target.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Metrics describe values of the target, overriding what the payload
+	// declares and the PerformanceIndex defaults.
+	Metrics []metricDesc `json:"metrics,omitempty"`
+	// SLOTarget overrides the SLO_TARGET of the burn rates.
+	SLOTarget float64 `json:"slo_target,omitempty"`
+	// SLOs are the objectives whose error budgets are reported.
+	SLOs []slo `json:"slos,omitempty"`
+	// Sinks name the sinks the samples of the target are forwarded to.
+	Sinks []string `json:"sinks,omitempty"`
+	// Push targets are not scraped: apps push their metric.Metric JSON to
+	// /api/push instead. Once nothing was pushed for StaleAfter, 5m by
+	// default, the target is marked stale.
+	Push       bool   `json:"push,omitempty"`
+	StaleAfter string `json:"stale_after,omitempty"`
+	// ScrapeInterval and ScrapeTimeout override SCRAPE_INTERVAL and
+	// SCRAPE_TIMEOUT for the target.
+	ScrapeInterval string `json:"scrape_interval,omitempty"`
+	ScrapeTimeout  string `json:"scrape_timeout,omitempty"`
+
+	decoder    decoder
+	staleAfter time.Duration
+	interval   time.Duration
+	timeout    time.Duration
+}
+
+// fileConfig is the content of CONFIG_FILE.
+type fileConfig struct {
+	Targets []target     `json:"targets"`
+	Sinks   []sinkConfig `json:"sinks"`
+}
+
+func loadConfig() (*config, error) {
+	var err error
+	cfg := &config{}
+
+	port := os.Getenv("APP_PORT")
+	service := os.Getenv("SERVICE_NAME")
+	if len(port) == 0 {
+		port = "3000"
+	}
+	if len(service) == 0 {
+		service = "localhost"
+	}
+	cfg.Targets = []target{{Name: service, URL: "http://" + service + ":" + port + "/metrics"}}
+	if file := os.Getenv("CONFIG_FILE"); len(file) > 0 {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var fc fileConfig
+		if err := json.Unmarshal(data, &fc); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", file, err)
+		}
+		if len(fc.Targets) == 0 {
+			return nil, fmt.Errorf("%s lists no targets", file)
+		}
+		cfg.Targets = fc.Targets
+		cfg.Sinks = fc.Sinks
+	}
+	names := map[string]bool{}
+	for i := range cfg.Targets {
+		t := &cfg.Targets[i]
+		if len(t.Name) == 0 || (len(t.URL) == 0 && !t.Push) {
+			return nil, fmt.Errorf("target %d needs a name and a url", i)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate target %s", t.Name)
+		}
+		names[t.Name] = true
+		if t.decoder, err = newDecoder(*t); err != nil {
+			return nil, err
+		}
+		if t.Push {
+			if _, ok := t.decoder.(legacyDecoder); !ok || len(t.URL) > 0 {
+				return nil, fmt.Errorf("target %s: push targets take metric.Metric JSON and have no url", t.Name)
+			}
+			t.staleAfter = 5 * time.Minute
+			if len(t.StaleAfter) > 0 {
+				if t.staleAfter, err = parseDuration(t.StaleAfter); err != nil {
+					return nil, fmt.Errorf("target %s: invalid stale_after %q", t.Name, t.StaleAfter)
+				}
+			}
+		}
+		for _, d := range t.Metrics {
+			if len(d.Name) == 0 || (d.Type != gaugeType && d.Type != counterType) {
+				return nil, fmt.Errorf("target %s: metric %q needs a name and a type of gauge or counter", t.Name, d.Name)
+			}
+		}
+		slos := map[string]bool{}
+		for j := range t.SLOs {
+			o := &t.SLOs[j]
+			if err := o.validate(); err != nil {
+				return nil, fmt.Errorf("target %s: %v", t.Name, err)
+			}
+			if slos[o.Name] {
+				return nil, fmt.Errorf("target %s: duplicate slo %s", t.Name, o.Name)
+			}
+			slos[o.Name] = true
+		}
+	}
+
+	if cfg.ScrapeInterval, err = envDuration("SCRAPE_INTERVAL", 15*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.ScrapeTimeout, err = envDuration("SCRAPE_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if cfg.ScrapeConcurrency, err = envInt("SCRAPE_CONCURRENCY", 16); err != nil {
+		return nil, err
+	}
+	if cfg.ScrapeErrorLogInterval, err = envDuration("SCRAPE_ERROR_LOG_INTERVAL", time.Minute); err != nil {
+		return nil, err
+	}
+	// A delay of 0 shuts down right away.
+	if os.Getenv("SHUTDOWN_DELAY") != "0" {
+		if cfg.ShutdownDelay, err = envDuration("SHUTDOWN_DELAY", 5*time.Second); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ShutdownTimeout, err = envDuration("SHUTDOWN_TIMEOUT", 20*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.StorageCapacity, err = envInt("STORAGE_CAPACITY", 5760); err != nil {
+		return nil, err
+	}
+	if cfg.RenderCacheSize, err = envInt("RENDER_CACHE_SIZE", 256); err != nil {
+		return nil, err
+	}
+	cfg.StoragePath = os.Getenv("STORAGE_PATH")
+	cfg.PushToken = os.Getenv("PUSH_TOKEN")
+	if s := os.Getenv("SLO_TARGET"); len(s) > 0 {
+		if cfg.SLOTarget, err = strconv.ParseFloat(s, 64); err != nil || cfg.SLOTarget <= 0 || cfg.SLOTarget >= 1 {
+			return nil, fmt.Errorf("invalid SLO_TARGET %q, want a ratio such as 0.995", s)
+		}
+	}
+	windows := os.Getenv("BURN_RATE_WINDOWS")
+	if len(windows) == 0 {
+		windows = "5m,1h,6h"
+	}
+	for _, w := range strings.Split(windows, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(w))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid BURN_RATE_WINDOWS %q", windows)
+		}
+		cfg.BurnRateWindows = append(cfg.BurnRateWindows, d)
+	}
+	cfg.RemoteWrite.URL = os.Getenv("REMOTE_WRITE_URL")
+	if u := cfg.RemoteWrite.URL; len(u) > 0 && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		return nil, fmt.Errorf("invalid REMOTE_WRITE_URL %q, want an http or https URL", u)
+	}
+	if cfg.RemoteWrite.queueConfig, err = envQueueConfig("REMOTE_WRITE_"); err != nil {
+		return nil, err
+	}
+	cfg.OTLP.URL = os.Getenv("OTLP_URL")
+	if u := cfg.OTLP.URL; len(u) > 0 && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		return nil, fmt.Errorf("invalid OTLP_URL %q, want an http or https URL", u)
+	}
+	cfg.OTLP.Encoding = os.Getenv("OTLP_ENCODING")
+	switch cfg.OTLP.Encoding {
+	case "":
+		cfg.OTLP.Encoding = "protobuf"
+	case "protobuf", "json":
+	default:
+		return nil, fmt.Errorf("invalid OTLP_ENCODING %q, want protobuf or json", cfg.OTLP.Encoding)
+	}
+	if cfg.OTLP.Headers, err = envPairs("OTLP_HEADERS"); err != nil {
+		return nil, err
+	}
+	if cfg.OTLP.queueConfig, err = envQueueConfig("OTLP_"); err != nil {
+		return nil, err
+	}
+	if err := validateSinks(cfg); err != nil {
+		return nil, err
+	}
+	for i := range cfg.Targets {
+		t := &cfg.Targets[i]
+		if t.SLOTarget < 0 || t.SLOTarget >= 1 {
+			return nil, fmt.Errorf("target %s: invalid slo_target %v, want a ratio such as 0.995", t.Name, t.SLOTarget)
+		}
+		if len(t.ScrapeInterval) > 0 {
+			if t.interval, err = parseDuration(t.ScrapeInterval); err != nil {
+				return nil, fmt.Errorf("target %s: invalid scrape_interval %q", t.Name, t.ScrapeInterval)
+			}
+		}
+		if len(t.ScrapeTimeout) > 0 {
+			if t.timeout, err = parseDuration(t.ScrapeTimeout); err != nil {
+				return nil, fmt.Errorf("target %s: invalid scrape_timeout %q", t.Name, t.ScrapeTimeout)
+			}
+		}
+		if timeout, interval := cfg.scrapeTimeout(*t), cfg.scrapeInterval(*t); timeout > interval && !t.Push {
+			return nil, fmt.Errorf("target %s: scrape timeout %s is longer than the scrape interval %s", t.Name, timeout, interval)
+		}
+	}
+	return cfg, nil
+}
+
+// deriver returns the deriver of the values computed for t. Without an
+// slo_target, the burn rates follow the first request SLO of t.
+func (cfg *config) deriver(t target) deriver {
+	d := deriver{sloTarget: cfg.SLOTarget, windows: cfg.BurnRateWindows}
+	for _, o := range t.SLOs {
+		if len(o.Field) == 0 {
+			d.sloTarget = o.Objective
+			break
+		}
+	}
+	if t.SLOTarget > 0 {
+		d.sloTarget = t.SLOTarget
+	}
+	return d
+}
+
+// scrapeInterval returns how often t is scraped.
+func (cfg *config) scrapeInterval(t target) time.Duration {
+	if t.interval > 0 {
+		return t.interval
+	}
+	return cfg.ScrapeInterval
+}
+
+// scrapeTimeout returns how long a scrape of t may take: its own timeout,
+// else SCRAPE_TIMEOUT, else its scrape interval.
+func (cfg *config) scrapeTimeout(t target) time.Duration {
+	switch {
+	case t.timeout > 0:
+		return t.timeout
+	case cfg.ScrapeTimeout > 0:
+		return cfg.ScrapeTimeout
+	}
+	return cfg.scrapeInterval(t)
+}
+
+// target returns the target with the given name, or the first target when
+// name is empty.
+func (cfg *config) target(name string) (target, error) {
+	for _, t := range cfg.Targets {
+		if len(name) == 0 || t.Name == name {
+			return t, nil
+		}
+	}
+	return target{}, fmt.Errorf("unknown target %q", name)
+}
+
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	s := os.Getenv(key)
+	if len(s) == 0 {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", key, s)
+	}
+	return d, nil
+}
+
+// parseDuration is time.ParseDuration that also accepts whole days and
+// weeks, such as 30d or 4w.
+func parseDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	if unit, ok := units[strings.TrimLeft(s, "0123456789")]; ok {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * unit, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// envQueueConfig reads the queue settings of an exporter from the
+// variables starting with prefix.
+func envQueueConfig(prefix string) (queueConfig, error) {
+	var err error
+	c := queueConfig{WALPath: os.Getenv(prefix + "WAL_PATH")}
+	if c.BatchSize, err = envInt(prefix+"BATCH_SIZE", defaultQueueConfig.BatchSize); err != nil {
+		return c, err
+	}
+	if c.Capacity, err = envInt(prefix+"QUEUE_CAPACITY", defaultQueueConfig.Capacity); err != nil {
+		return c, err
+	}
+	if c.FlushInterval, err = envDuration(prefix+"FLUSH_INTERVAL", defaultQueueConfig.FlushInterval); err != nil {
+		return c, err
+	}
+	if c.Timeout, err = envDuration(prefix+"TIMEOUT", defaultQueueConfig.Timeout); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// envPairs reads a comma separated list of key=value pairs, such as
+// Authorization=Bearer token,X-Scope-OrgID=apps.
+func envPairs(key string) (map[string]string, error) {
+	s := os.Getenv(key)
+	if len(s) == 0 {
+		return nil, nil
+	}
+	pairs := map[string]string{}
+	for _, p := range strings.Split(s, ",") {
+		eq := strings.IndexByte(p, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid %s %q, want key=value pairs", key, s)
+		}
+		pairs[strings.TrimSpace(p[:eq])] = strings.TrimSpace(p[eq+1:])
+	}
+	return pairs, nil
+}
+
+func envInt(key string, def int) (int, error) {
+	s := os.Getenv(key)
+	if len(s) == 0 {
+		return def, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", key, s)
+	}
+	return i, nil
+}
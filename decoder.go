@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	metric "github.com/rootsongjc/k8s-app-monitor-test/service"
+)
+
+// decoder turns the payload served by a target into a sample, and returns
+// the descriptions of its values the payload declares, if any. The collector
+// sets the sample time and the static target labels.
+type decoder interface {
+	decode(r io.Reader) (sample, []metricDesc, error)
+}
+
+// decodeError is returned when a payload cannot be decoded.
+type decodeError struct {
+	err error
+}
+
+func (e decodeError) Error() string {
+	return "decoding payload: " + e.err.Error()
+}
+
+// newDecoder returns the decoder selected by the target.
+func newDecoder(t target) (decoder, error) {
+	switch t.Decoder {
+	case "", "legacy":
+		return legacyDecoder{}, nil
+	case "prometheus":
+		return prometheusDecoder{}, nil
+	case "json":
+		if len(t.Fields) == 0 {
+			return nil, fmt.Errorf("target %s: the json decoder needs fields", t.Name)
+		}
+		d := jsonDecoder{fields: map[string]jsonPath{}, labels: map[string]jsonPath{}}
+		for name, p := range t.Fields {
+			path, err := parseJSONPath(p)
+			if err != nil {
+				return nil, fmt.Errorf("target %s: field %s: %v", t.Name, name, err)
+			}
+			d.fields[name] = path
+		}
+		for name, p := range t.LabelPaths {
+			path, err := parseJSONPath(p)
+			if err != nil {
+				return nil, fmt.Errorf("target %s: label %s: %v", t.Name, name, err)
+			}
+			d.labels[name] = path
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("target %s: unknown decoder %q", t.Name, t.Decoder)
+}
+
+// legacyLabels maps the metric.Metric JSON keys to sample labels.
+var legacyLabels = map[string]string{"app_name": "app", "domain": "domain", "host": "host"}
+
+// legacyDecoder reads the metric.Metric JSON of the k8s-app-monitor-test
+// service. Every number in performance_index or at the top level becomes a
+// value named after its key with the first letter in upper case, so
+// avgLatency is AvgLatency and fields beyond PerformanceIndex flow through.
+type legacyDecoder struct{}
+
+func (legacyDecoder) decode(r io.Reader) (sample, []metricDesc, error) {
+	var doc map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return sample{}, nil, decodeError{err}
+	}
+	s := sample{Labels: map[string]string{}, Values: map[string]float64{}}
+	for key, label := range legacyLabels {
+		if v, ok := doc[key].(string); ok {
+			s.Labels[label] = v
+		}
+	}
+	addNumbers(s.Values, doc)
+	if pi, ok := doc["performance_index"].(map[string]interface{}); ok {
+		addNumbers(s.Values, pi)
+	}
+	return s, nil, nil
+}
+
+func addNumbers(values map[string]float64, obj map[string]interface{}) {
+	for key, v := range obj {
+		if f, ok := v.(float64); ok && len(key) > 0 {
+			values[strings.ToUpper(key[:1])+key[1:]] = f
+		}
+	}
+}
+
+// sampleFromMetric maps a metric.Metric onto the sample model the way the
+// legacy decoder does.
+func sampleFromMetric(m metric.Metric) sample {
+	data, _ := json.Marshal(m)
+	s, _, _ := legacyDecoder{}.decode(bytes.NewReader(data))
+	return s
+}
+
+// metricFromSample maps a sample of a legacy target back onto the
+// metric.Metric it was decoded from. Values beyond the PerformanceIndex
+// fields are dropped.
+func metricFromSample(s sample) metric.Metric {
+	return metric.Metric{
+		PerformanceIndex: metric.PerformanceIndex{
+			FailRatio:     s.Values["FailRatio"],
+			FailAmount:    int64(s.Values["FailAmount"]),
+			AccessAmount:  int64(s.Values["AccessAmount"]),
+			MaxConcurrent: int64(s.Values["MaxConcurrent"]),
+			MinLatency:    int64(s.Values["MinLatency"]),
+			AvgLatency:    int64(s.Values["AvgLatency"]),
+		},
+		Host:    s.Labels["host"],
+		AppName: s.Labels["app"],
+		Domain:  s.Labels["domain"],
+	}
+}
+
+// prometheusDecoder reads the Prometheus text exposition format. Every series
+// becomes a value named after the metric and its labels, e.g.
+// http_requests_total{code="200"}.
+type prometheusDecoder struct{}
+
+func (prometheusDecoder) decode(r io.Reader) (sample, []metricDesc, error) {
+	s := sample{Labels: map[string]string{}, Values: map[string]float64{}}
+	descs := map[string]*metricDesc{}
+	desc := func(name string) *metricDesc {
+		if d, ok := descs[name]; ok {
+			return d
+		}
+		d := &metricDesc{Name: name, Type: gaugeType}
+		descs[name] = d
+		return d
+	}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '#' {
+			// # HELP name text and # TYPE name type describe a metric.
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 4 {
+				continue
+			}
+			switch fields[1] {
+			case "HELP":
+				desc(fields[2]).Help = fields[3]
+			case "TYPE":
+				if fields[3] == counterType {
+					desc(fields[2]).Type = counterType
+				}
+			}
+			continue
+		}
+		name, value, err := parsePrometheusLine(line)
+		if err != nil {
+			return sample{}, nil, decodeError{fmt.Errorf("line %d: %v", n, err)}
+		}
+		// NaN and infinite values cannot be stored or charted.
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		s.Values[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return sample{}, nil, err
+	}
+	list := make([]metricDesc, 0, len(descs))
+	for _, d := range descs {
+		list = append(list, *d)
+	}
+	return s, list, nil
+}
+
+// parsePrometheusLine parses a sample line and returns the series name with
+// its labels in canonical order, and the value. Timestamps are ignored.
+func parsePrometheusLine(line string) (string, float64, error) {
+	i := strings.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return "", 0, fmt.Errorf("malformed sample %q", line)
+	}
+	name, rest := line[:i], line[i:]
+	var labels []string
+	if rest[0] == '{' {
+		end := -1
+		inQuote := false
+		for j := 1; j < len(rest); j++ {
+			switch {
+			case rest[j] == '\\' && inQuote:
+				j++
+			case rest[j] == '"':
+				inQuote = !inQuote
+			case rest[j] == '}' && !inQuote:
+				end = j
+			}
+			if end >= 0 {
+				break
+			}
+		}
+		if end < 0 {
+			return "", 0, fmt.Errorf("unterminated labels in %q", line)
+		}
+		var err error
+		if labels, err = parsePrometheusLabels(rest[1:end]); err != nil {
+			return "", 0, err
+		}
+		rest = rest[end+1:]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", 0, fmt.Errorf("malformed sample %q", line)
+	}
+	value, err := parsePrometheusValue(fields[0])
+	if err != nil {
+		return "", 0, err
+	}
+	if len(labels) > 0 {
+		sort.Strings(labels)
+		name += "{" + strings.Join(labels, ",") + "}"
+	}
+	return name, value, nil
+}
+
+// parsePrometheusLabels returns the label pairs of s formatted as name="value".
+func parsePrometheusLabels(s string) ([]string, error) {
+	var labels []string
+	for len(strings.TrimSpace(s)) > 0 {
+		s = strings.TrimLeft(s, " \t,")
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 || eq+1 >= len(s) || s[eq+1] != '"' {
+			return nil, fmt.Errorf("malformed labels %q", s)
+		}
+		name := strings.TrimSpace(s[:eq])
+		value, err := strconv.QuotedPrefix(s[eq+1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed label value in %q", s)
+		}
+		labels = append(labels, name+"="+value)
+		s = strings.TrimLeft(s[eq+1+len(value):], " \t")
+		if len(s) > 0 && s[0] != ',' {
+			return nil, fmt.Errorf("malformed labels %q", s)
+		}
+	}
+	return labels, nil
+}
+
+func parsePrometheusValue(s string) (float64, error) {
+	switch s {
+	case "+Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// jsonDecoder reads any JSON document, taking values and labels from the
+// paths configured on the target.
+type jsonDecoder struct {
+	fields map[string]jsonPath
+	labels map[string]jsonPath
+}
+
+func (d jsonDecoder) decode(r io.Reader) (sample, []metricDesc, error) {
+	var doc interface{}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return sample{}, nil, decodeError{err}
+	}
+	s := sample{Labels: map[string]string{}, Values: map[string]float64{}}
+	for name, path := range d.fields {
+		v, ok := path.lookup(doc)
+		if !ok {
+			return sample{}, nil, decodeError{fmt.Errorf("field %s: nothing at %s", name, path)}
+		}
+		f, err := toFloat(v)
+		if err != nil {
+			return sample{}, nil, decodeError{fmt.Errorf("field %s: %v", name, err)}
+		}
+		s.Values[name] = f
+	}
+	for name, path := range d.labels {
+		if v, ok := path.lookup(doc); ok && v != nil {
+			s.Labels[name] = fmt.Sprint(v)
+		}
+	}
+	return s, nil, nil
+}
+
+// toFloat converts a JSON number, numeric string or bool to a value. NaN and
+// infinite values are rejected, since they cannot be stored or charted.
+func toFloat(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, err
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("%q is not a finite number", v)
+		}
+		return f, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+// jsonPath is a JSONPath-style selector of object keys and array indexes,
+// such as $.performance_index.avgLatency or $.pods[0]['app name'].
+type jsonPath []interface{}
+
+func parseJSONPath(s string) (jsonPath, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("path %q must start with $", s)
+	}
+	var p jsonPath
+	rest := s[1:]
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if len(key) == 0 {
+				return nil, fmt.Errorf("empty key in path %q", s)
+			}
+			p = append(p, key)
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in path %q", s)
+			}
+			inner := rest[1:end]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				p = append(p, inner[1:len(inner)-1])
+			} else if i, err := strconv.Atoi(inner); err == nil && i >= 0 {
+				p = append(p, i)
+			} else {
+				return nil, fmt.Errorf("invalid index %q in path %q", inner, s)
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q in path %q", rest[0], s)
+		}
+	}
+	return p, nil
+}
+
+func (p jsonPath) lookup(doc interface{}) (interface{}, bool) {
+	for _, step := range p {
+		switch step := step.(type) {
+		case string:
+			obj, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if doc, ok = obj[step]; !ok {
+				return nil, false
+			}
+		case int:
+			arr, ok := doc.([]interface{})
+			if !ok || step >= len(arr) {
+				return nil, false
+			}
+			doc = arr[step]
+		}
+	}
+	return doc, true
+}
+
+func (p jsonPath) String() string {
+	s := "$"
+	for _, step := range p {
+		switch step := step.(type) {
+		case string:
+			s += "['" + step + "']"
+		case int:
+			s += "[" + strconv.Itoa(step) + "]"
+		}
+	}
+	return s
+}
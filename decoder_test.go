@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrometheusDecoder(t *testing.T) {
+	payload := `# HELP http_requests_total Requests.
+# TYPE http_requests_total counter
+http_requests_total{method="get",code="200"} 1027 1395066363000
+http_requests_total{code="500",method="get"} 3
+latency_seconds_bucket{le="+Inf"} 12
+latency_seconds_sum 1.5e-1
+msg_total{text="a \"quoted\", {braced} value"} 2
+summary_quantile NaN
+`
+	s, _, err := prometheusDecoder{}.decode(strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		`http_requests_total{code="200",method="get"}`:   1027,
+		`http_requests_total{code="500",method="get"}`:   3,
+		`latency_seconds_bucket{le="+Inf"}`:              12,
+		`latency_seconds_sum`:                            0.15,
+		`msg_total{text="a \"quoted\", {braced} value"}`: 2,
+	}
+	if len(s.Values) != len(want) {
+		t.Errorf("got %d values %v, want %d", len(s.Values), s.Values, len(want))
+	}
+	for name, v := range want {
+		if s.Values[name] != v {
+			t.Errorf("%s = %v, want %v", name, s.Values[name], v)
+		}
+	}
+
+	for _, bad := range []string{"novalue", `m{a="b" 1`, `m{a=b} 1`, "m 1 2 3", "m abc"} {
+		if _, _, err := (prometheusDecoder{}).decode(strings.NewReader(bad)); err == nil {
+			t.Errorf("decoding %q succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestJSONDecoder(t *testing.T) {
+	d, err := newDecoder(target{
+		Name:    "orders",
+		Decoder: "json",
+		Fields: map[string]string{
+			"AvgLatency": "$.stats.latency.avg",
+			"Errors":     "$.stats['error count']",
+			"FirstPod":   "$.pods[0].load",
+			"Healthy":    "$.healthy",
+		},
+		LabelPaths: map[string]string{"app": "$.name", "host": "$.pods[0].host"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := `{"name": "orders", "healthy": true,
+		"stats": {"latency": {"avg": 42.5}, "error count": "7"},
+		"pods": [{"host": "node-1", "load": 0.5}]}`
+	s, _, err := d.decode(strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range map[string]float64{"AvgLatency": 42.5, "Errors": 7, "FirstPod": 0.5, "Healthy": 1} {
+		if s.Values[name] != v {
+			t.Errorf("%s = %v, want %v", name, s.Values[name], v)
+		}
+	}
+	if s.Labels["app"] != "orders" || s.Labels["host"] != "node-1" {
+		t.Errorf("labels = %v", s.Labels)
+	}
+
+	if _, _, err := d.decode(strings.NewReader(`{"stats": {}}`)); err == nil {
+		t.Error("decoding a payload without the fields succeeded, want an error")
+	}
+	for _, v := range []string{"NaN", "Inf", "+Inf", "-inf"} {
+		payload := `{"stats": {"latency": {"avg": 1}, "error count": "` + v + `"}, "pods": [{"load": 0}], "healthy": true}`
+		if _, _, err := d.decode(strings.NewReader(payload)); err == nil {
+			t.Errorf("decoding %s succeeded, want an error", v)
+		}
+	}
+	for _, bad := range []string{"stats.avg", "$.a[", "$..a", "$.a[x]"} {
+		if _, err := parseJSONPath(bad); err == nil {
+			t.Errorf("parsing %q succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestLegacyDecoderExtraFields(t *testing.T) {
+	payload := `{"performance_index": {"failRatio": 0.5, "avgLatency": 40, "p99Latency": 180},
+		"host": "node-1", "app_name": "test-app", "domain": "test-domain", "cpuSeconds": 3.5, "version": "v2"}`
+	s, _, err := legacyDecoder{}.decode(strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range map[string]float64{"FailRatio": 0.5, "AvgLatency": 40, "P99Latency": 180, "CpuSeconds": 3.5} {
+		if s.Values[name] != v {
+			t.Errorf("%s = %v, want %v", name, s.Values[name], v)
+		}
+	}
+	if len(s.Values) != 4 {
+		t.Errorf("got values %v, want 4", s.Values)
+	}
+	if s.Labels["app"] != "test-app" || s.Labels["domain"] != "test-domain" || s.Labels["host"] != "node-1" {
+		t.Errorf("labels = %v", s.Labels)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// counterIncrease returns how much a counter grew from prev to cur. A counter
+// that went down was reset by an app restart and grew by cur since then.
+func counterIncrease(prev, cur float64) float64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// burnRateName names the burn rate value of a window, e.g. BurnRate5m.
+func burnRateName(window time.Duration) string {
+	// Unlike time.Duration.String, leave out zero units: 1h rather than 1h0m0s.
+	name := "BurnRate"
+	for _, unit := range []struct {
+		d      time.Duration
+		suffix string
+	}{{time.Hour, "h"}, {time.Minute, "m"}, {time.Second, "s"}} {
+		if n := window / unit.d; n > 0 {
+			name += strconv.Itoa(int(n)) + unit.suffix
+			window -= n * unit.d
+		}
+	}
+	return name
+}
+
+// deriver adds values computed from consecutive samples to new samples:
+//
+//   - <Counter>Rate, the per second rate of every counter,
+//   - ComputedFailRatio, the FailAmount increase over the AccessAmount
+//     increase since the previous sample, to check the reported FailRatio,
+//   - BurnRate<window>, how fast the error budget of the SLO target is
+//     spent over each window, where 1 spends it exactly in the SLO period.
+type deriver struct {
+	sloTarget float64
+	windows   []time.Duration
+}
+
+// maxWindow is how much history derive needs before the new sample.
+func (d deriver) maxWindow() time.Duration {
+	var max time.Duration
+	for _, w := range d.windows {
+		if w > max {
+			max = w
+		}
+	}
+	return max
+}
+
+// derive returns cur with the derived values added and their descriptions.
+// history holds the earlier samples of the target, oldest first, covering
+// at least maxWindow.
+func (d deriver) derive(t target, history []sample, cur sample) (sample, []metricDesc) {
+	if len(history) == 0 {
+		return cur, nil
+	}
+	prev := history[len(history)-1]
+	dt := cur.Time.Sub(prev.Time).Seconds()
+	if dt <= 0 {
+		return cur, nil
+	}
+
+	values := make(map[string]float64, len(cur.Values)+len(d.windows)+4)
+	for k, v := range cur.Values {
+		values[k] = v
+	}
+	var descs []metricDesc
+	for key, v := range cur.Values {
+		desc := metricDescs.describe(t, key)
+		p, ok := prev.Values[key]
+		if desc.Type != counterType || !ok {
+			continue
+		}
+		name, _ := splitSeries(key)
+		rateKey := name + "Rate" + key[len(name):]
+		values[rateKey] = counterIncrease(p, v) / dt
+		unit := "1/s"
+		if len(desc.Unit) > 0 {
+			unit = desc.Unit + "/s"
+		}
+		descs = append(descs, metricDesc{Name: name + "Rate", Type: gaugeType, Unit: unit, Help: "Per second rate of " + name + "."})
+	}
+
+	if access, fail, ok := requestIncrease(prev, cur); ok && access > 0 {
+		values["ComputedFailRatio"] = fail / access
+		descs = append(descs, metricDesc{Name: "ComputedFailRatio", Type: gaugeType, Unit: "ratio",
+			Help: "FailAmount increase over AccessAmount increase since the previous sample."})
+	}
+
+	if d.sloTarget > 0 && d.sloTarget < 1 {
+		samples := append(history, cur)
+		for _, w := range d.windows {
+			since := cur.Time.Add(-w)
+			var access, fail float64
+			for i := len(samples) - 1; i > 0 && !samples[i-1].Time.Before(since); i-- {
+				if a, f, ok := requestIncrease(samples[i-1], samples[i]); ok {
+					access += a
+					fail += f
+				}
+			}
+			if access <= 0 {
+				continue
+			}
+			name := burnRateName(w)
+			values[name] = fail / access / (1 - d.sloTarget)
+			descs = append(descs, metricDesc{Name: name, Type: gaugeType,
+				Help: "Error budget burn rate over " + w.String() + "."})
+		}
+	}
+
+	cur.Values = values
+	return cur, descs
+}
+
+// requestIncrease returns the AccessAmount and FailAmount increases from prev
+// to cur.
+func requestIncrease(prev, cur sample) (access, fail float64, ok bool) {
+	a0, ok1 := prev.Values["AccessAmount"]
+	f0, ok2 := prev.Values["FailAmount"]
+	a1, ok3 := cur.Values["AccessAmount"]
+	f1, ok4 := cur.Values["FailAmount"]
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return 0, 0, false
+	}
+	return counterIncrease(a0, a1), counterIncrease(f0, f1), true
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func requestSample(at time.Time, access, fail float64) sample {
+	return sample{
+		Time:   at,
+		Labels: map[string]string{"app": "test-app"},
+		Values: map[string]float64{"AccessAmount": access, "FailAmount": fail, "FailRatio": 0.1},
+	}
+}
+
+func TestDeriveRates(t *testing.T) {
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	d := deriver{}
+	tgt := target{Name: "derive-rates"}
+
+	s, _ := d.derive(tgt, []sample{requestSample(start, 1000, 100)}, requestSample(start.Add(10*time.Second), 1500, 150))
+	if got := s.Values["AccessAmountRate"]; got != 50 {
+		t.Errorf("AccessAmountRate = %v, want 50", got)
+	}
+	if got := s.Values["FailAmountRate"]; got != 5 {
+		t.Errorf("FailAmountRate = %v, want 5", got)
+	}
+	if got := s.Values["ComputedFailRatio"]; got != 0.1 {
+		t.Errorf("ComputedFailRatio = %v, want 0.1", got)
+	}
+	if _, ok := s.Values["FailRatioRate"]; ok {
+		t.Error("FailRatio is a gauge and should not get a rate")
+	}
+
+	// The app restarted: the counters count from zero again.
+	s, _ = d.derive(tgt, []sample{requestSample(start, 1000, 100)}, requestSample(start.Add(10*time.Second), 200, 40))
+	if got := s.Values["AccessAmountRate"]; got != 20 {
+		t.Errorf("AccessAmountRate after reset = %v, want 20", got)
+	}
+	if got := s.Values["ComputedFailRatio"]; got != 0.2 {
+		t.Errorf("ComputedFailRatio after reset = %v, want 0.2", got)
+	}
+
+	s, _ = d.derive(tgt, nil, requestSample(start, 1000, 100))
+	if len(s.Values) != 3 {
+		t.Errorf("first sample got derived values %v", s.Values)
+	}
+}
+
+func TestDeriveBurnRates(t *testing.T) {
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	d := deriver{sloTarget: 0.99, windows: []time.Duration{time.Minute, time.Hour}}
+	tgt := target{Name: "derive-burn"}
+
+	// 100 requests per 30s. Half an hour with 1% failures, then a minute
+	// with 10% failures: 80 failures in 6200 requests overall.
+	var history []sample
+	access, fail := 0.0, 0.0
+	for i := 0; i <= 60; i++ {
+		history = append(history, requestSample(start.Add(time.Duration(i)*30*time.Second), access, fail))
+		access += 100
+		fail++
+	}
+	fail += 9
+	history = append(history, requestSample(start.Add(61*30*time.Second), access, fail))
+	access += 100
+	fail += 10
+	s, descs := d.derive(tgt, history, requestSample(start.Add(62*30*time.Second), access, fail))
+
+	if got := s.Values["BurnRate1m"]; math.Abs(got-10) > 1e-9 {
+		t.Errorf("BurnRate1m = %v, want 10", got)
+	}
+	if got, want := s.Values["BurnRate1h"], 80.0/6200/0.01; math.Abs(got-want) > 1e-9 {
+		t.Errorf("BurnRate1h = %v, want %v", got, want)
+	}
+	found := false
+	for _, desc := range descs {
+		found = found || desc.Name == "BurnRate1h"
+	}
+	if !found {
+		t.Errorf("descriptions %v miss BurnRate1h", descs)
+	}
+}
+
+func TestBurnRateName(t *testing.T) {
+	for window, want := range map[time.Duration]string{
+		5 * time.Minute:           "BurnRate5m",
+		10 * time.Second:          "BurnRate10s",
+		time.Hour:                 "BurnRate1h",
+		90 * time.Minute:          "BurnRate1h30m",
+		30 * 24 * time.Hour:       "BurnRate720h",
+		time.Minute + time.Second: "BurnRate1m1s",
+	} {
+		if got := burnRateName(window); got != want {
+			t.Errorf("burnRateName(%v) = %s, want %s", window, got, want)
+		}
+	}
+}
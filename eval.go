@@ -0,0 +1,467 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	chart "github.com/wcharczuk/go-chart"
+)
+
+// maxQuerySteps bounds the points of a range query.
+const maxQuerySteps = 11000
+
+// point is a value of a series at a time.
+type point struct {
+	T time.Time
+	V float64
+}
+
+// evalSeries is the value of an expression for one label set at every step
+// of an evaluation. NaN marks the steps without a value.
+type evalSeries struct {
+	name   string
+	labels map[string]string
+	values []float64
+}
+
+// evalResult is the value of an expression: a number at every step, or a
+// set of series.
+type evalResult struct {
+	scalar []float64
+	series []evalSeries
+}
+
+// queryEngine evaluates queries over the stored samples of every target.
+type queryEngine struct {
+	cfg   *config
+	store *store
+	// lookback is how long an instant selector keeps the latest value of
+	// a series when no newer one was stored.
+	lookback time.Duration
+}
+
+func newQueryEngine(cfg *config, s *store) *queryEngine {
+	return &queryEngine{cfg: cfg, store: s, lookback: 2 * cfg.ScrapeInterval}
+}
+
+// querySteps returns the evaluation times of a range query ending at end.
+func querySteps(end time.Time, window, step time.Duration) ([]time.Time, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("invalid step %v", step)
+	}
+	if window/step >= maxQuerySteps {
+		return nil, fmt.Errorf("window %v over step %v exceeds %d points", window, step, maxQuerySteps)
+	}
+	var steps []time.Time
+	for t := end.Add(-window); !t.After(end); t = t.Add(step) {
+		steps = append(steps, t)
+	}
+	return steps, nil
+}
+
+// eval evaluates e at steps, oldest first.
+func (q *queryEngine) eval(e expr, steps []time.Time) (evalResult, error) {
+	switch e := e.(type) {
+	case *numberExpr:
+		values := make([]float64, len(steps))
+		for i := range values {
+			values[i] = e.value
+		}
+		return evalResult{scalar: values}, nil
+	case *selectorExpr:
+		var result evalResult
+		for _, raw := range q.selectRaw(e, steps[0].Add(-q.lookback), steps[len(steps)-1]) {
+			s := evalSeries{name: e.name, labels: raw.labels, values: make([]float64, len(steps))}
+			for i, t := range steps {
+				s.values[i] = math.NaN()
+				// The latest point at or before t, within the lookback.
+				j := sort.Search(len(raw.points), func(j int) bool { return raw.points[j].T.After(t) }) - 1
+				if j >= 0 && t.Sub(raw.points[j].T) <= q.lookback {
+					s.values[i] = raw.points[j].V
+				}
+			}
+			result.series = append(result.series, s)
+		}
+		return result, nil
+	case *callExpr:
+		fn := rangeFuncs[e.fn]
+		var result evalResult
+		for _, raw := range q.selectRaw(e.arg, steps[0].Add(-e.arg.rng), steps[len(steps)-1]) {
+			s := evalSeries{labels: raw.labels, values: make([]float64, len(steps))}
+			for i, t := range steps {
+				// The points in (t-range, t].
+				from := sort.Search(len(raw.points), func(j int) bool { return raw.points[j].T.After(t.Add(-e.arg.rng)) })
+				to := sort.Search(len(raw.points), func(j int) bool { return raw.points[j].T.After(t) })
+				s.values[i] = math.NaN()
+				if v, ok := fn(raw.points[from:to]); ok {
+					s.values[i] = v
+				}
+			}
+			result.series = append(result.series, s)
+		}
+		return result, nil
+	case *negExpr:
+		arg, err := q.eval(e.arg, steps)
+		if err != nil {
+			return evalResult{}, err
+		}
+		return arg.apply(func(_ int, v float64) float64 { return -v }), nil
+	case *binaryExpr:
+		lhs, err := q.eval(e.lhs, steps)
+		if err != nil {
+			return evalResult{}, err
+		}
+		rhs, err := q.eval(e.rhs, steps)
+		if err != nil {
+			return evalResult{}, err
+		}
+		return binaryOp(e.op, lhs, rhs)
+	}
+	return evalResult{}, fmt.Errorf("cannot evaluate %s", e)
+}
+
+// apply returns r with f applied to the value at every step. Series lose
+// their name, as they no longer hold the named value.
+func (r evalResult) apply(f func(step int, v float64) float64) evalResult {
+	if r.scalar != nil {
+		values := make([]float64, len(r.scalar))
+		for i, v := range r.scalar {
+			values[i] = f(i, v)
+		}
+		return evalResult{scalar: values}
+	}
+	var result evalResult
+	for _, s := range r.series {
+		values := make([]float64, len(s.values))
+		for i, v := range s.values {
+			values[i] = f(i, v)
+		}
+		result.series = append(result.series, evalSeries{labels: s.labels, values: values})
+	}
+	return result
+}
+
+func arithmetic(op byte, a, b float64) float64 {
+	switch op {
+	case '+':
+		return a + b
+	case '-':
+		return a - b
+	case '*':
+		return a * b
+	}
+	return a / b
+}
+
+// binaryOp combines two results step by step. A number combines with every
+// series; two sets of series pair up by their full label sets, dropping the
+// unpaired. There is no on or ignoring, so a side holding several series
+// with the same labels, such as several value names, is an error rather than
+// paired arbitrarily.
+func binaryOp(op byte, lhs, rhs evalResult) (evalResult, error) {
+	switch {
+	case lhs.scalar != nil && rhs.scalar != nil:
+		values := make([]float64, len(lhs.scalar))
+		for i := range values {
+			values[i] = arithmetic(op, lhs.scalar[i], rhs.scalar[i])
+		}
+		return evalResult{scalar: values}, nil
+	case lhs.scalar != nil:
+		return rhs.apply(func(i int, v float64) float64 { return arithmetic(op, lhs.scalar[i], v) }), nil
+	case rhs.scalar != nil:
+		return lhs.apply(func(i int, v float64) float64 { return arithmetic(op, v, rhs.scalar[i]) }), nil
+	}
+	for _, side := range []struct {
+		name   string
+		series []evalSeries
+	}{{"left", lhs.series}, {"right", rhs.series}} {
+		seen := map[string]bool{}
+		for _, s := range side.series {
+			key := labelSetKey(s.labels)
+			if seen[key] {
+				return evalResult{}, fmt.Errorf("several series on the %s side of %c have the labels %s, operands must match one to one", side.name, op, formatLabelSet(s.labels))
+			}
+			seen[key] = true
+		}
+	}
+	byLabels := map[string]evalSeries{}
+	for _, s := range rhs.series {
+		byLabels[labelSetKey(s.labels)] = s
+	}
+	var result evalResult
+	for _, l := range lhs.series {
+		r, ok := byLabels[labelSetKey(l.labels)]
+		if !ok {
+			continue
+		}
+		values := make([]float64, len(l.values))
+		for i := range values {
+			values[i] = arithmetic(op, l.values[i], r.values[i])
+		}
+		result.series = append(result.series, evalSeries{labels: l.labels, values: values})
+	}
+	return result, nil
+}
+
+// formatLabelSet formats labels as a selector, such as {app="orders"}.
+func formatLabelSet(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, k := range sortedLabelNames(labels) {
+		pairs = append(pairs, k+"="+strconv.Quote(labels[k]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// rawSeries is a stored value of one target and label set over time.
+type rawSeries struct {
+	name   string
+	labels map[string]string
+	points []point
+}
+
+// selectRaw returns the stored series sel selects between two times.
+func (q *queryEngine) selectRaw(sel *selectorExpr, from, to time.Time) []rawSeries {
+	var result []rawSeries
+	index := map[string]int{}
+	q.scan(from, to, func(name string, labels map[string]string, p point) {
+		if len(sel.name) > 0 && name != sel.name {
+			return
+		}
+		labels["__name__"] = name
+		ok := matchesAll(sel.matchers, labels)
+		delete(labels, "__name__")
+		if !ok {
+			return
+		}
+		id := name + "\xff" + labelSetKey(labels)
+		i, ok := index[id]
+		if !ok {
+			i = len(result)
+			index[id] = i
+			result = append(result, rawSeries{name: name, labels: labels})
+		}
+		result[i].points = append(result[i].points, p)
+	})
+	return result
+}
+
+// scan calls f with every stored value between two times, oldest first per
+// target, with a fresh map of its labels: those of its sample, the target
+// name and, for Prometheus series, the series labels. Every sample also
+// yields the synthetic up series, 1 for a scrape and 0 for the marker of a
+// failed scrape or stale push target.
+func (q *queryEngine) scan(from, to time.Time, f func(name string, labels map[string]string, p point)) {
+	for _, t := range q.cfg.Targets {
+		for _, smp := range q.store.samplesBetween(t.Name, from, to.Add(time.Nanosecond)) {
+			up := map[string]string{}
+			for k, v := range t.Labels {
+				up[k] = v
+			}
+			for k, v := range smp.Labels {
+				up[k] = v
+			}
+			up["target"] = t.Name
+			if len(smp.Values) > 0 {
+				f("up", up, point{smp.Time, 1})
+			} else {
+				f("up", up, point{smp.Time, 0})
+			}
+			for key, v := range smp.Values {
+				name, seriesLabels := splitSeries(key)
+				labels := make(map[string]string, len(t.Labels)+len(smp.Labels)+len(seriesLabels)+1)
+				for k, v := range t.Labels {
+					labels[k] = v
+				}
+				for k, v := range smp.Labels {
+					labels[k] = v
+				}
+				for k, v := range seriesLabels {
+					labels[k] = v
+				}
+				labels["target"] = t.Name
+				f(name, labels, point{smp.Time, v})
+			}
+		}
+	}
+}
+
+func matchesAll(matchers []labelMatcher, labels map[string]string) bool {
+	for _, m := range matchers {
+		if !m.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// querySeries is a series of a query result without the steps lacking a
+// value.
+type querySeries struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Points []queryPoint      `json:"points"`
+}
+
+type queryPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// evalQuery parses and evaluates a query at steps.
+func (q *queryEngine) evalQuery(query string, steps []time.Time) (evalResult, error) {
+	e, err := parseQuery(query)
+	if err != nil {
+		return evalResult{}, err
+	}
+	return q.eval(e, steps)
+}
+
+// run parses and evaluates a query at steps and returns the series with at
+// least one value. A number is a single series without labels.
+func (q *queryEngine) run(query string, steps []time.Time) ([]querySeries, error) {
+	r, err := q.evalQuery(query, steps)
+	if err != nil {
+		return nil, err
+	}
+	if r.scalar != nil {
+		r.series = []evalSeries{{labels: map[string]string{}, values: r.scalar}}
+	}
+	result := []querySeries{}
+	for _, s := range r.series {
+		qs := querySeries{Name: seriesName(s.name, s.labels), Labels: s.labels}
+		for i, v := range s.values {
+			// Missing values and divisions by zero are left out.
+			if !math.IsNaN(v) && !math.IsInf(v, 0) {
+				qs.Points = append(qs.Points, queryPoint{steps[i], v})
+			}
+		}
+		if len(qs.Points) > 0 {
+			result = append(result, qs)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// parseQueryRequest reads the query, window and step parameters of req. A
+// zero window evaluates the query once, at now.
+func (q *queryEngine) parseQueryRequest(req *http.Request, now time.Time, defaultWindow time.Duration) (string, []time.Time, error) {
+	query := strings.TrimSpace(req.URL.Query().Get("query"))
+	if len(query) == 0 {
+		return "", nil, fmt.Errorf("missing query parameter")
+	}
+	window, err := parseWindow(req, "window", defaultWindow)
+	if err != nil {
+		return "", nil, err
+	}
+	if window == 0 {
+		return query, []time.Time{now}, nil
+	}
+	step, err := parseWindow(req, "step", q.cfg.ScrapeInterval)
+	if err != nil {
+		return "", nil, err
+	}
+	steps, err := querySteps(now, window, step)
+	return query, steps, err
+}
+
+// apiQuery serves the result of a query as JSON: at now, or over a window
+// at every step.
+func apiQuery(q *queryEngine) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		query, steps, err := q.parseQueryRequest(req, time.Now(), 0)
+		if err != nil {
+			writeJSONError(res, http.StatusBadRequest, err)
+			return
+		}
+		series, err := q.run(query, steps)
+		if err != nil {
+			writeJSONError(res, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, map[string]interface{}{"query": query, "series": series})
+	}
+}
+
+// querySeriesLine returns the points of qs as a time series whose line
+// breaks at the steps without a value, such as when its target was down.
+func querySeriesLine(qs querySeries, steps []time.Time) gappedSeries {
+	ts := gappedSeries{TimeSeries: chart.TimeSeries{Name: qs.Name}}
+	next := 0
+	for _, p := range qs.Points {
+		i := next
+		for i < len(steps) && steps[i].Before(p.Time) {
+			i++
+		}
+		if i > next && len(ts.XValues) > 0 {
+			ts.breaks = append(ts.breaks, len(ts.XValues))
+		}
+		ts.XValues = append(ts.XValues, p.Time)
+		ts.YValues = append(ts.YValues, p.Value)
+		next = i + 1
+	}
+	return ts
+}
+
+// renderQueryChart draws every series of a query result at steps over time.
+func renderQueryChart(w io.Writer, title string, result []querySeries, steps []time.Time, opts chartOptions) error {
+	var series []chart.Series
+	var values [][]float64
+	for _, qs := range result {
+		ts := querySeriesLine(qs, steps)
+		if len(ts.XValues) >= 2 {
+			series = append(series, ts)
+			values = append(values, ts.YValues)
+		}
+	}
+	if len(series) == 0 {
+		return errors.New("not enough points to chart")
+	}
+	c := chart.Chart{
+		Title: title,
+		TitleStyle: chart.Style{
+			Show: true,
+		},
+		Width:  opts.Width,
+		Height: opts.Height,
+		XAxis: chart.XAxis{
+			Style:          chart.Style{Show: true},
+			ValueFormatter: chart.TimeValueFormatterWithFormat("15:04:05"),
+		},
+		YAxis: chart.YAxis{
+			Style: chart.Style{Show: true},
+			Range: flatRange(values...),
+		},
+		Series: series,
+	}
+	c.Elements = []chart.Renderable{chart.Legend(&c)}
+	return render(w, c, opts)
+}
+
+// renderQueryChartRequest renders the chart of the query of req over its
+// window, default 1h.
+func renderQueryChartRequest(w io.Writer, req *http.Request, q *queryEngine, opts chartOptions) (int, error) {
+	query, steps, err := q.parseQueryRequest(req, time.Now(), time.Hour)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	e, err := parseQuery(query)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	result, err := q.run(query, steps)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := renderQueryChart(w, e.String(), result, steps, opts); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
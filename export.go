@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// exporter sends the scraped samples to a backend. export queues a sample
+// and never blocks the scrape; run sends the queue in the background.
+type exporter interface {
+	name() string
+	export(t target, smp sample)
+	// run sends queued samples until ctx is done.
+	run(ctx context.Context)
+	// close sends what is left until the deadline and releases the
+	// exporter.
+	close(deadline context.Context) error
+	// pending returns the number of queued samples.
+	pending() int
+}
+
+// newExporters returns the exporters enabled by cfg.
+func newExporters(cfg *config) ([]exporter, error) {
+	var exporters []exporter
+	if len(cfg.RemoteWrite.URL) > 0 {
+		w, err := newRemoteWriter(cfg.RemoteWrite)
+		if err != nil {
+			return nil, err
+		}
+		exporters = append(exporters, w)
+	}
+	if len(cfg.OTLP.URL) > 0 {
+		o, err := newOTLPExporter(cfg.OTLP)
+		if err != nil {
+			return nil, err
+		}
+		exporters = append(exporters, o)
+	}
+	for _, sc := range cfg.Sinks {
+		targets := map[string]bool{}
+		for _, t := range cfg.Targets {
+			if contains(t.Sinks, sc.Name) {
+				targets[t.Name] = true
+			}
+		}
+		s, err := newSink(sc, targets)
+		if err != nil {
+			return nil, err
+		}
+		exporters = append(exporters, s)
+	}
+	return exporters, nil
+}
+
+// exporterGroup runs exporters until stopped.
+type exporterGroup struct {
+	exporters []exporter
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+func startExporters(exporters []exporter) *exporterGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &exporterGroup{exporters: exporters, cancel: cancel}
+	for _, e := range exporters {
+		g.wg.Add(1)
+		go func(e exporter) {
+			defer g.wg.Done()
+			e.run(ctx)
+		}(e)
+	}
+	return g
+}
+
+// stop stops the background sends, then closes every exporter, giving it
+// until the deadline to send what is left.
+func (g *exporterGroup) stop(deadline context.Context) {
+	g.cancel()
+	g.wg.Wait()
+	for _, e := range g.exporters {
+		if err := e.close(deadline); err != nil {
+			logger.Error("closing exporter failed", "exporter", e.name(), "error", err)
+		}
+	}
+}
+
+// exportLabel and exportSample are a label and a value of a series, as the
+// exporters queue them.
+type exportLabel struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type exportSample struct {
+	Labels []exportLabel `json:"labels"`
+	// Timestamp is in milliseconds since the epoch.
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+	// Type is counter for values that only grow, and Unit the unit of
+	// the value, for the exporters keeping metric metadata.
+	Type string `json:"type,omitempty"`
+	Unit string `json:"unit,omitempty"`
+}
+
+// exportSamples converts a sample of t into an export sample per value,
+// labelled with __name__, the sample labels such as app, domain and host,
+// the Prometheus series labels and the target name. Values that are not
+// finite are left out.
+func exportSamples(t target, smp sample) []exportSample {
+	keys := make([]string, 0, len(smp.Values))
+	for key := range smp.Values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var samples []exportSample
+	for _, key := range keys {
+		v := smp.Values[key]
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		name, seriesLabels := splitSeries(key)
+		labels := map[string]string{}
+		for k, v := range smp.Labels {
+			labels[promLabelName(k)] = v
+		}
+		for k, v := range seriesLabels {
+			labels[promLabelName(k)] = v
+		}
+		labels["target"] = t.Name
+		labels["__name__"] = promMetricName(name)
+		d := metricDescs.describe(t, key)
+		s := exportSample{Timestamp: smp.Time.UnixNano() / int64(time.Millisecond), Value: v, Type: d.Type, Unit: d.Unit}
+		for k, v := range labels {
+			s.Labels = append(s.Labels, exportLabel{k, v})
+		}
+		sort.Slice(s.Labels, func(i, j int) bool { return s.Labels[i].Name < s.Labels[j].Name })
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+// promMetricName replaces the characters Prometheus does not allow in
+// metric names with underscores.
+func promMetricName(s string) string {
+	return promName(s, true)
+}
+
+// promLabelName is promMetricName for label names, which exclude colons.
+func promLabelName(s string) string {
+	return promName(s, false)
+}
+
+func promName(s string, colons bool) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && isDigit(c)) || (colons && c == ':') {
+			continue
+		}
+		b[i] = '_'
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
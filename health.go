@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	healthUnknown = "unknown"
+	healthUp      = "up"
+	healthDown    = "down"
+)
+
+// targetHealth is the state of a target after its last scrape, or its last
+// push for push targets.
+type targetHealth struct {
+	// Health is unknown until the first scrape, then up or down.
+	Health     string    `json:"health"`
+	LastScrape time.Time `json:"last_scrape"`
+	// LastScrapeDuration is zero for pushes.
+	LastScrapeDuration float64 `json:"last_scrape_duration_seconds"`
+	// LastSuccess is the time of the last successful scrape, zero if there
+	// was none.
+	LastSuccess         time.Time `json:"last_success"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+// updateHealth records the result of a scrape of, or a push to, the target
+// named name.
+func (c *collector) updateHealth(name string, at time.Time, duration time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.health[name]
+	h.LastScrape = at
+	h.LastScrapeDuration = duration.Seconds()
+	if err != nil {
+		h.Health = healthDown
+		h.ConsecutiveFailures++
+		h.LastError = err.Error()
+	} else {
+		h.Health = healthUp
+		h.LastSuccess = at
+		h.ConsecutiveFailures = 0
+		h.LastError = ""
+	}
+	c.health[name] = h
+}
+
+// targetHealth returns the health of the target named name.
+func (c *collector) targetHealth(name string) targetHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.health[name]
+}
+
+// storeMarker stores a sample without values for t, the marker of a failed
+// scrape or of a stale push target. It keeps the labels of the latest
+// sample, so the target still matches selectors on them, and makes time
+// series charts show a gap instead of connecting the values around it.
+func (c *collector) storeMarker(t target, at time.Time) {
+	marker := stampSample(t, sample{Labels: map[string]string{}, Values: map[string]float64{}}, at)
+	if latest, ok := c.store.latest(t.Name); ok {
+		for k, v := range latest.Labels {
+			marker.Labels[k] = v
+		}
+	}
+	c.store.add(t.Name, marker)
+}
+
+// targetStatus is a target with its health, as the targets page and API
+// list it.
+type targetStatus struct {
+	Name string `json:"name"`
+	// URL is empty for push targets. Its password and secret looking query
+	// parameters are redacted, since the targets are listed unauthenticated.
+	URL    string            `json:"url,omitempty"`
+	Push   bool              `json:"push,omitempty"`
+	Labels map[string]string `json:"labels"`
+	// ScrapeInterval is how often the target is scraped, or for push
+	// targets how long until it goes stale.
+	ScrapeInterval string `json:"scrape_interval"`
+	ScrapeTimeout  string `json:"scrape_timeout,omitempty"`
+	targetHealth
+}
+
+// targetStatuses returns the status of every target in configuration order,
+// only those with the given health unless it is empty.
+func (c *collector) targetStatuses(health string) []targetStatus {
+	statuses := []targetStatus{}
+	for _, t := range c.cfg.Targets {
+		st := targetStatus{
+			Name:           t.Name,
+			URL:            redactURL(t.URL),
+			Push:           t.Push,
+			Labels:         targetLabels(t, c.store),
+			ScrapeInterval: c.cfg.scrapeInterval(t).String(),
+			ScrapeTimeout:  c.cfg.scrapeTimeout(t).String(),
+			targetHealth:   c.targetHealth(t.Name),
+		}
+		if t.Push {
+			st.ScrapeInterval, st.ScrapeTimeout = t.staleAfter.String(), ""
+		}
+		if len(health) == 0 || st.Health == health {
+			statuses = append(statuses, st)
+		}
+	}
+	return statuses
+}
+
+// parseHealth reads the health query parameter filtering the targets.
+func parseHealth(req *http.Request) (string, error) {
+	switch h := req.URL.Query().Get("health"); h {
+	case "", healthUnknown, healthUp, healthDown:
+		return h, nil
+	default:
+		return "", fmt.Errorf("invalid health %q, want up, down or unknown", h)
+	}
+}
+
+var targetsPage = template.Must(template.New("targets").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Format("2006-01-02 15:04:05 MST")
+	},
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return fmt.Sprintf("(%s ago)", time.Since(t).Truncate(time.Second))
+	},
+	"labels": func(labels map[string]string) []string {
+		var pairs []string
+		for _, k := range sortedLabelNames(labels) {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", k, labels[k]))
+		}
+		return pairs
+	},
+	"color": func(health string) string {
+		return map[string]string{healthUp: "green", healthDown: "red"}[health]
+	},
+	"chartURL": func(name string) string {
+		return path + "?" + url.Values{"target": {name}, "type": {"timeseries"}}.Encode()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>Targets</title></head>
+<body>
+<h1>Targets</h1>
+<p>Show <a href="/targets">all</a>, <a href="/targets?health=up">up</a>, <a href="/targets?health=down">down</a> or <a href="/targets?health=unknown">unknown</a> targets, or get them as <a href="/api/targets">JSON</a>.</p>
+{{if not .}}<p>No targets match.</p>{{else}}
+<table>
+<tr><th align="left">Target</th><th align="left">Endpoint</th><th align="left">Labels</th><th align="left">Interval</th><th align="left">Timeout</th><th align="left">Health</th><th align="left">Last scrape</th><th align="left">Duration</th><th align="left">Last success</th><th align="left">Consecutive failures</th><th align="left">Last error</th></tr>
+{{range .}}
+<tr>
+<td><a href="{{chartURL .Name}}">{{.Name}}</a></td>
+<td>{{if .Push}}push{{else}}<a href="{{.URL}}">{{.URL}}</a>{{end}}</td>
+<td>{{range labels .Labels}}{{.}}<br>{{end}}</td>
+<td>{{if .Push}}stale after {{end}}{{.ScrapeInterval}}</td>
+<td>{{.ScrapeTimeout}}</td>
+<td><font color="{{color .Health}}">{{.Health}}</font></td>
+<td>{{time .LastScrape}} {{ago .LastScrape}}</td>
+<td>{{if not .Push}}{{printf "%.3fs" .LastScrapeDuration}}{{end}}</td>
+<td>{{time .LastSuccess}} {{ago .LastSuccess}}</td>
+<td>{{.ConsecutiveFailures}}</td>
+<td>{{.LastError}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+// targetsStatusPage serves the status of the targets as HTML.
+func targetsStatusPage(c *collector) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		health, err := parseHealth(req)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := targetsPage.Execute(res, c.targetStatuses(health)); err != nil {
+			requestLogger(req).Error("rendering targets page failed", "error", err)
+		}
+	}
+}
+
+// apiTargets serves the status of the targets as JSON.
+func apiTargets(c *collector) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		health, err := parseHealth(req)
+		if err != nil {
+			writeJSONError(res, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, map[string]interface{}{"targets": c.targetStatuses(health)})
+	}
+}
+
+// sensitiveParams are the substrings of query parameter names whose values
+// redactURL hides.
+var sensitiveParams = []string{"token", "key", "secret", "password", "passwd", "auth", "signature", "credential"}
+
+// redactURL hides the password and the values of secret looking query
+// parameters of a target URL.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	q := u.Query()
+	redacted := false
+	for name := range q {
+		for _, p := range sensitiveParams {
+			if strings.Contains(strings.ToLower(name), p) {
+				q.Set(name, "xxxxx")
+				redacted = true
+				break
+			}
+		}
+	}
+	if redacted {
+		u.RawQuery = q.Encode()
+	}
+	return u.Redacted()
+}
+
+func sortedLabelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// agentMetricsPath serves the agent's own metrics, kept apart from the
+// application metrics it scrapes.
+const agentMetricsPath = "/agent/metrics"
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	sizeBuckets    = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+	scrapeDuration = newHistogramVec("agent_scrape_duration_seconds",
+		"Duration of target scrapes.", latencyBuckets, "target")
+	scrapesTotal = newCounterVec("agent_scrapes_total",
+		"Target scrapes by result.", "target", "result")
+	scrapeFailures = newCounterVec("agent_scrape_failures_total",
+		"Failed target scrapes by error class.", "target", "class")
+	scrapesSkipped = newCounterVec("agent_scrapes_skipped_total",
+		"Scrapes skipped because the previous scrape of the target was still running.", "target")
+	pushedSamples = newCounterVec("agent_pushed_samples_total",
+		"Samples pushed to push targets.", "target")
+	renderDuration = newHistogramVec("agent_render_duration_seconds",
+		"Duration of chart renders.", latencyBuckets, "format")
+	renderBytes = newHistogramVec("agent_render_bytes",
+		"Size of rendered charts.", sizeBuckets, "format")
+	renderCacheRequests = newCounterVec("agent_render_cache_requests_total",
+		"Chart requests by result: hit when served from the render cache, coalesced when waiting for a render in progress, or miss.", "result")
+	httpRequests = newCounterVec("agent_http_requests_total",
+		"HTTP requests by handler and status code.", "handler", "code")
+	exportedSamples = newCounterVec("agent_export_samples_total",
+		"Samples handled by exporters by result: sent, dropped from a full queue or rejected by the backend.", "exporter", "result")
+	exportRequests = newCounterVec("agent_export_requests_total",
+		"Exporter requests by status code, error when no response was received, or sent for UDP packets.", "exporter", "code")
+)
+
+// counterVec is a set of counters partitioned by label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	c.values[labelKey(labelValues)] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, splitLabelKey(key)), formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is a set of histograms partitioned by label values.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		values := splitLabelKey(key)
+		labels := append(append([]string(nil), h.labels...), "le")
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, append(values, formatFloat(b))), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, append(values, "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), s.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, labels []string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels, splitLabelKey(key)), formatFloat(values[key]))
+	}
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func splitLabelKey(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, "\xff")
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelValueEscaper escapes label values the way the text format does,
+// which knows no other escapes than these.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelValueEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// scrapeErrorClass groups scrape errors into a small set of label values.
+func scrapeErrorClass(err error) string {
+	if err == context.DeadlineExceeded {
+		return "timeout"
+	}
+	if _, ok := err.(statusError); ok {
+		return "http_status"
+	}
+	if _, ok := err.(decodeError); ok {
+		return "decode"
+	}
+	if e, ok := err.(net.Error); ok {
+		if e.Timeout() {
+			return "timeout"
+		}
+		return "connection"
+	}
+	return "other"
+}
+
+// statusResponseWriter remembers the status code written by a handler.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// instrument counts the requests served by h under the given handler name.
+func instrument(handler string, h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		w := &statusResponseWriter{ResponseWriter: res, code: http.StatusOK}
+		h(w, req)
+		httpRequests.inc(handler, strconv.Itoa(w.code))
+	}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// observeRender records the duration and size of a chart render.
+func observeRender(format string, start time.Time, size int64) {
+	renderDuration.observe(time.Since(start).Seconds(), format)
+	renderBytes.observe(float64(size), format)
+}
+
+// agentMetrics serves the agent's own metrics in the Prometheus text format.
+func agentMetrics(s *store, c *collector, exporters []exporter) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w := bufio.NewWriter(res)
+		defer w.Flush()
+
+		scrapeDuration.write(w)
+		scrapesTotal.write(w)
+		scrapeFailures.write(w)
+		scrapesSkipped.write(w)
+		pushedSamples.write(w)
+		renderDuration.write(w)
+		renderBytes.write(w)
+		renderCacheRequests.write(w)
+		httpRequests.write(w)
+		exportedSamples.write(w)
+		exportRequests.write(w)
+
+		occupancy := map[string]float64{}
+		for name, n := range s.occupancy() {
+			occupancy[name] = float64(n)
+		}
+		writeGauge(w, "agent_storage_samples", "Samples held in storage per target.", []string{"target"}, occupancy)
+		writeGauge(w, "agent_storage_capacity", "Samples storage can hold per target.", nil,
+			map[string]float64{"": float64(s.capacity)})
+		up := map[string]float64{}
+		failures := map[string]float64{}
+		lastSuccess := map[string]float64{}
+		for _, t := range c.targetStatuses("") {
+			up[t.Name], failures[t.Name] = 0, float64(t.ConsecutiveFailures)
+			if t.Health == healthUp {
+				up[t.Name] = 1
+			}
+			if !t.LastSuccess.IsZero() {
+				lastSuccess[t.Name] = float64(t.LastSuccess.UnixNano()) / 1e9
+			}
+		}
+		writeGauge(w, "agent_target_up", "Whether the last scrape of, or push to, a target succeeded.", []string{"target"}, up)
+		writeGauge(w, "agent_target_consecutive_failures", "Failed scrapes of a target since its last success.", []string{"target"}, failures)
+		writeGauge(w, "agent_target_last_success_timestamp_seconds", "Time of the last successful scrape of a target.", []string{"target"}, lastSuccess)
+		queued := map[string]float64{}
+		for _, e := range exporters {
+			queued[e.name()] = float64(e.pending())
+		}
+		writeGauge(w, "agent_export_queue_samples", "Samples queued per exporter.", []string{"exporter"}, queued)
+		writeGauge(w, "agent_goroutines", "Number of goroutines.", nil,
+			map[string]float64{"": float64(runtime.NumGoroutine())})
+	}
+}
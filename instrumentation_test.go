@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgentMetricsExposition(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(`{"app_name": "orders", "performance_index": {"accessAmount": 100, "avgLatency": 48, "failAmount": 2}}`))
+	}))
+	defer server.Close()
+	// The name needs every escape of the text format, and a tab that needs
+	// none.
+	name := "orders \"eu\"\\west\n\tb"
+	tg := target{Name: name, URL: server.URL, decoder: legacyDecoder{}}
+	cfg := &config{Targets: []target{tg}, ScrapeInterval: time.Minute}
+	s, _ := newStore(100, "")
+	c := newCollector(cfg, s, nil)
+	c.scrape(context.Background(), tg, logger, &failureLimiter{interval: time.Minute})
+
+	res := httptest.NewRecorder()
+	agentMetrics(s, c, nil)(res, httptest.NewRequest("GET", agentMetricsPath, nil))
+	if ct := res.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	// Every sample follows the HELP and TYPE of its family, which are
+	// given once.
+	types := map[string]string{}
+	var family string
+	for _, line := range strings.Split(strings.TrimSuffix(res.Body.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			if len(fields) != 4 {
+				t.Fatalf("malformed TYPE line %q", line)
+			}
+			if _, ok := types[fields[2]]; ok {
+				t.Errorf("family %s typed twice", fields[2])
+			}
+			family, types[fields[2]] = fields[2], fields[3]
+			continue
+		}
+		metric := line[:strings.IndexAny(line, "{ ")]
+		if types[family] == "histogram" {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				if strings.HasSuffix(metric, suffix) {
+					metric = strings.TrimSuffix(metric, suffix)
+					break
+				}
+			}
+		}
+		if metric != family {
+			t.Errorf("sample %q outside of its family, after # TYPE %s", line, family)
+		}
+	}
+	for name, typ := range map[string]string{
+		"agent_scrape_duration_seconds": "histogram",
+		"agent_scrapes_total":           "counter",
+		"agent_http_requests_total":     "counter",
+		"agent_storage_samples":         "gauge",
+		"agent_target_up":               "gauge",
+		"agent_goroutines":              "gauge",
+	} {
+		if types[name] != typ {
+			t.Errorf("%s is typed %q, want %s", name, types[name], typ)
+		}
+	}
+
+	escaped := `target="orders \"eu\"\\west\n` + "\t" + `b"`
+	for _, want := range []string{
+		`agent_scrapes_total{` + escaped + `,result="success"} 1`,
+		`agent_scrape_duration_seconds_bucket{` + escaped + `,le="+Inf"} 1`,
+		`agent_scrape_duration_seconds_count{` + escaped + `} 1`,
+		`agent_storage_samples{` + escaped + `} 1`,
+		`agent_target_up{` + escaped + `} 1`,
+		`agent_target_consecutive_failures{` + escaped + `} 0`,
+		`agent_storage_capacity 100`,
+	} {
+		if !strings.Contains(res.Body.String(), want+"\n") {
+			t.Errorf("exposition lacks %q", want)
+		}
+	}
+}
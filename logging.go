@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// logger is replaced by setupLogging once the environment has been read.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// setupLogging configures the logger from LOG_FORMAT (logfmt or json) and
+// LOG_LEVEL (debug, info, warn or error).
+func setupLogging() error {
+	var level slog.Level
+	if s := os.Getenv("LOG_LEVEL"); len(s) > 0 {
+		if err := level.UnmarshalText([]byte(s)); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL %q", s)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(os.Getenv("LOG_FORMAT")) {
+	case "", "logfmt":
+		logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q", os.Getenv("LOG_FORMAT"))
+	}
+	return nil
+}
+
+type requestIDKey struct{}
+
+// withRequestID propagates the X-Request-ID header of a request, generating
+// one when it is missing, and echoes it on the response.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if len(id) == 0 {
+			id = newRequestID()
+		}
+		res.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	})
+}
+
+// accessLog logs every request served by h with its status and duration.
+// Probes are logged at debug level, since kubelet sends them every few
+// seconds.
+func accessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		w := &statusResponseWriter{ResponseWriter: res, code: http.StatusOK}
+		h.ServeHTTP(w, req)
+		level := slog.LevelInfo
+		if req.URL.Path == "/healthz" || req.URL.Path == "/readyz" {
+			level = slog.LevelDebug
+		}
+		requestLogger(req).Log(req.Context(), level, "request", "status", w.code, "duration", time.Since(start).String())
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLogger returns the logger for the request, carrying its ID.
+func requestLogger(req *http.Request) *slog.Logger {
+	l := logger.With("method", req.Method, "path", req.URL.Path)
+	if id, ok := req.Context().Value(requestIDKey{}).(string); ok {
+		l = l.With("request_id", id)
+	}
+	return l
+}
+
+// failureLimiter logs the first of a run of scrape failures and then at most
+// one line per interval, so a dead target does not flood the logs.
+type failureLimiter struct {
+	interval time.Duration
+
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+	failing    bool
+}
+
+// failure logs err unless a failure was logged less than interval ago.
+func (f *failureLimiter) failure(l *slog.Logger, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing && time.Since(f.last) < f.interval {
+		f.suppressed++
+		return
+	}
+	l.Warn("scrape failed", "error", err, "suppressed", f.suppressed)
+	f.failing = true
+	f.last = time.Now()
+	f.suppressed = 0
+}
+
+// success logs the recovery of a target that was failing.
+func (f *failureLimiter) success(l *slog.Logger) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing {
+		l.Info("scrape recovered", "suppressed", f.suppressed)
+	}
+	f.failing = false
+	f.suppressed = 0
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs makes logger write JSON lines to the returned buffer until the
+// test ends.
+func captureLogs(t *testing.T, level slog.Level) *bytes.Buffer {
+	var buf bytes.Buffer
+	saved := logger
+	logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level}))
+	t.Cleanup(func() { logger = saved })
+	return &buf
+}
+
+func TestAccessLog(t *testing.T) {
+	logs := captureLogs(t, slog.LevelInfo)
+	h := withRequestID(accessLog(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(res, req)
+		}
+	})))
+	for _, c := range []struct {
+		path, id string
+	}{
+		{"/api/metrics", "abc123"},
+		{"/missing", ""},
+		{"/healthz", ""},
+	} {
+		req := httptest.NewRequest("GET", c.path, nil)
+		if len(c.id) > 0 {
+			req.Header.Set(requestIDHeader, c.id)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var l map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &l); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		lines = append(lines, l)
+	}
+	// Probes are logged at debug level only.
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want one per request but the probe: %s", len(lines), logs)
+	}
+	for i, want := range []struct {
+		path   string
+		status float64
+	}{
+		{"/api/metrics", http.StatusOK},
+		{"/missing", http.StatusNotFound},
+	} {
+		l := lines[i]
+		if l["msg"] != "request" || l["method"] != "GET" || l["path"] != want.path || l["status"] != want.status {
+			t.Errorf("line %d = %v, want GET %s answered %v", i, l, want.path, want.status)
+		}
+		if id, _ := l["request_id"].(string); len(id) == 0 {
+			t.Errorf("line %d carries no request ID", i)
+		}
+		if d, err := time.ParseDuration(l["duration"].(string)); err != nil || d < 0 {
+			t.Errorf("line %d duration = %v", i, l["duration"])
+		}
+	}
+	if lines[0]["request_id"] != "abc123" {
+		t.Errorf("request ID = %v, want the one of the X-Request-ID header", lines[0]["request_id"])
+	}
+}
+
+func TestScrapeForwardsRequestID(t *testing.T) {
+	ids := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ids <- req.Header.Get(requestIDHeader)
+		res.Write([]byte(`{"app_name": "orders", "performance_index": {"accessAmount": 100, "avgLatency": 48, "failAmount": 2}}`))
+	}))
+	defer server.Close()
+	cfg := &config{Targets: []target{{Name: "orders", URL: server.URL, decoder: legacyDecoder{}}}, ScrapeInterval: time.Minute}
+	s, _ := newStore(100, "")
+
+	req := httptest.NewRequest("GET", path+"?type=bar&target=orders", nil)
+	req.Header.Set(requestIDHeader, "chart-7")
+	res := httptest.NewRecorder()
+	withRequestID(drawChart(cfg, s, newRenderCache(10))).ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("chart answered %d", res.Code)
+	}
+	if id := <-ids; id != "chart-7" {
+		t.Errorf("scrape carried request ID %q, want chart-7", id)
+	}
+}
@@ -1,76 +1,262 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
 	"os"
-
-	metric "github.com/rootsongjc/k8s-app-monitor-test/service"
-	chart "github.com/wcharczuk/go-chart"
+	"strings"
 )
 
-var m metric.Metric
-var path = "/k8s-app-monitor-agent"
+const usage = `Usage: k8s-app-monitor-agent [command] [flags]
+
+Commands:
+  serve    run the agent server (default)
+  render   scrape a target once and write its chart to a file
+  check    validate the configuration
+  scrape   scrape a target once and print its metric as JSON
+
+Run 'k8s-app-monitor-agent <command> -h' to list the flags of a command.
+`
+
+// envFlags lists the environment variables every command also accepts as a
+// flag, named after the variable in lower case with dashes.
+var envFlags = []struct {
+	env   string
+	usage string
+}{
+	{"PORT", "port to listen on"},
+	{"HEALTH_PORT", "port /healthz and /readyz are also served on, without client certificates"},
+	{"CONFIG_FILE", "JSON file listing the targets, instead of SERVICE_NAME and APP_PORT"},
+	{"SERVICE_NAME", "host name of the target service"},
+	{"APP_PORT", "port of the target service"},
+	{"SCRAPE_INTERVAL", "how often targets are scraped"},
+	{"SCRAPE_TIMEOUT", "how long a scrape may take, defaults to the scrape interval"},
+	{"SCRAPE_CONCURRENCY", "most scrapes running at once"},
+	{"SCRAPE_ERROR_LOG_INTERVAL", "minimum interval between scrape failure log lines of a target"},
+	{"SHUTDOWN_DELAY", "how long to keep serving, unready, before shutting down"},
+	{"SHUTDOWN_TIMEOUT", "how long to wait for requests and collectors on shutdown"},
+	{"STORAGE_PATH", "file samples are loaded from and flushed to"},
+	{"PUSH_TOKEN", "bearer token push requests must carry"},
+	{"STORAGE_CAPACITY", "number of samples kept per target"},
+	{"RENDER_CACHE_SIZE", "most rendered charts kept"},
+	{"SLO_TARGET", "share of requests that should succeed, enables burn rates"},
+	{"BURN_RATE_WINDOWS", "comma separated windows of the burn rates"},
+	{"REMOTE_WRITE_URL", "Prometheus remote write endpoint samples are exported to"},
+	{"REMOTE_WRITE_BATCH_SIZE", "most samples per remote write request"},
+	{"REMOTE_WRITE_QUEUE_CAPACITY", "most samples queued for remote write"},
+	{"REMOTE_WRITE_FLUSH_INTERVAL", "how often queued samples are sent"},
+	{"REMOTE_WRITE_TIMEOUT", "timeout of a remote write request"},
+	{"REMOTE_WRITE_WAL_PATH", "file the remote write queue is kept in across restarts"},
+	{"OTLP_URL", "OTLP/HTTP metrics endpoint samples are exported to"},
+	{"OTLP_ENCODING", "protobuf or json"},
+	{"OTLP_HEADERS", "comma separated key=value headers of OTLP requests"},
+	{"OTLP_BATCH_SIZE", "most samples per OTLP request"},
+	{"OTLP_QUEUE_CAPACITY", "most samples queued for OTLP"},
+	{"OTLP_FLUSH_INTERVAL", "how often queued OTLP samples are sent"},
+	{"OTLP_TIMEOUT", "timeout of an OTLP request"},
+	{"OTLP_WAL_PATH", "file the OTLP queue is kept in across restarts"},
+	{"TLS_CERT_FILE", "PEM encoded serving certificate, enables TLS"},
+	{"TLS_KEY_FILE", "PEM encoded private key"},
+	{"TLS_MIN_VERSION", "minimum TLS version"},
+	{"TLS_CLIENT_CA_FILE", "CA bundle to verify client certificates with"},
+	{"TLS_CLIENT_AUTH", "client certificate policy, require or optional"},
+	{"TLS_RELOAD_INTERVAL", "how often the TLS files are checked for changes"},
+	{"LOG_FORMAT", "log format, logfmt or json"},
+	{"LOG_LEVEL", "minimum log level"},
+	{"SIMULATE", "scenario of an in-process fake target to scrape instead of SERVICE_NAME"},
+	{"SIMULATE_PORT", "port of the simulated target, random by default"},
+}
+
+// stdout is where commands print their results.
+var stdout io.Writer = os.Stdout
 
 func main() {
-	listenPort := fmt.Sprintf(":%s", listenPort())
-	fmt.Printf("Listening on %s\n", listenPort)
-	http.HandleFunc(path, drawChart)
-	log.Fatal(http.ListenAndServe(listenPort, nil))
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	var err error
+	switch command {
+	case "serve":
+		err = runServe(args)
+	case "render":
+		err = runRender(args)
+	case "check":
+		err = runCheck(args)
+	case "scrape":
+		err = runScrape(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+	checkError(err)
 }
 
 func checkError(err error) {
 	if err != nil {
-		log.Fatalf("Get : %v", err)
+		logger.Error("exiting", "error", err)
+		os.Exit(1)
 	}
 }
-func drawChart(res http.ResponseWriter, req *http.Request) {
-	port := os.Getenv("APP_PORT")
-	service := os.Getenv("SERVICE_NAME")
-	if len(port) == 0 {
-		port = "3000"
+
+// newFlagSet returns the flag set of a command with the environment flags
+// registered. Use parseFlags to parse it.
+func newFlagSet(command string) *flag.FlagSet {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	for _, f := range envFlags {
+		name := strings.ToLower(strings.Replace(f.env, "_", "-", -1))
+		fs.String(name, os.Getenv(f.env), f.usage+" ($"+f.env+")")
 	}
-	if len(service) == 0 {
-		service = "localhost"
+	return fs
+}
+
+// parseFlags parses args and exports the environment flags that were set, so
+// they take precedence over the environment. It then sets up logging.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %v", fs.Args())
 	}
-	resp, err := http.Get("http://" + service + ":" + port + "/metrics")
-	checkError(err)
-	defer resp.Body.Close()
-	err = json.NewDecoder(resp.Body).Decode(&m)
-	checkError(err)
-	sbc := chart.BarChart{
-		Title: "AppName:" + m.AppName + "\nDomain:" + m.Domain + "\nHost:" + m.Host,
-		TitleStyle: chart.Style{
-			Show:                true,
-			TextHorizontalAlign: 1,
-		},
-		Height:   512,
-		BarWidth: 60,
-		XAxis: chart.Style{
-			Show: true,
-		},
-		YAxis: chart.YAxis{
-			Style: chart.Style{
-				Show: true,
-			},
-		},
-		Bars: []chart.Value{
-			{Value: m.FailRatio, Label: "FailRatio"},
-			{Value: float64(m.FailAmount), Label: "FailAmount"},
-			{Value: float64(m.AccessAmount), Label: "AccessAmount"},
-			{Value: float64(m.MaxConcurrent), Label: "MaxConcurrent"},
-			{Value: float64(m.MinLatency), Label: "MinLatency"},
-			{Value: float64(m.AvgLatency), Label: "AvgLatency"},
-		},
-	}
-
-	res.Header().Set("Content-Type", "image/png")
-	err = sbc.Render(chart.PNG, res)
+	for _, f := range envFlags {
+		name := strings.ToLower(strings.Replace(f.env, "_", "-", -1))
+		fs.Visit(func(set *flag.Flag) {
+			if set.Name == name {
+				os.Setenv(f.env, set.Value.String())
+			}
+		})
+	}
+	return setupLogging()
+}
+
+// simulate starts the simulated target if SIMULATE asks for one. Only the
+// commands scraping targets repeatedly or printing a scrape call it; check
+// and render ignore SIMULATE.
+func simulate() error {
+	scenario := os.Getenv("SIMULATE")
+	if len(scenario) == 0 {
+		return nil
+	}
+	// The simulated target is only scraped through SERVICE_NAME and
+	// APP_PORT, which CONFIG_FILE replaces.
+	if len(os.Getenv("CONFIG_FILE")) > 0 {
+		return fmt.Errorf("SIMULATE cannot be combined with CONFIG_FILE")
+	}
+	return startSimulator(scenario)
+}
+
+// loadTarget loads the config and returns the target with the given name, or
+// the first target when name is empty.
+func loadTarget(name string) (target, error) {
+	cfg, err := loadConfig()
 	if err != nil {
-		fmt.Printf("Error rendering chart: %v\n", err)
+		return target{}, err
+	}
+	return cfg.target(name)
+}
+
+func runServe(args []string) error {
+	if err := parseFlags(newFlagSet("serve"), args); err != nil {
+		return err
+	}
+	if err := simulate(); err != nil {
+		return err
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	return serve(cfg)
+}
+
+func runRender(args []string) error {
+	fs := newFlagSet("render")
+	name := fs.String("target", "", "name of the target to render, defaults to the first one")
+	out := fs.String("o", "chart.png", "output file, the extension selects png or svg")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	format, err := formatFromFile(*out)
+	if err != nil {
+		return err
+	}
+	t, err := loadTarget(*name)
+	if err != nil {
+		return err
+	}
+	smp, err := scrapeTarget(context.Background(), http.DefaultClient, t)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	opts := chartOptions{Format: format, Width: defaultChartWidth, Height: defaultChartHeight}
+	if err := renderBarChart(f, smp, opts); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func runCheck(args []string) error {
+	if err := parseFlags(newFlagSet("check"), args); err != nil {
+		return err
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := tlsConfig(ctx); err != nil {
+		return err
+	}
+	for _, t := range cfg.Targets {
+		decoder := t.Decoder
+		if len(decoder) == 0 {
+			decoder = "legacy"
+		}
+		if t.Push {
+			fmt.Fprintf(stdout, "target %s: push, stale after %s\n", t.Name, t.staleAfter)
+			continue
+		}
+		fmt.Fprintf(stdout, "target %s: %s (%s)\n", t.Name, redactURL(t.URL), decoder)
+	}
+	fmt.Fprintln(stdout, "config OK")
+	return nil
+}
+
+func runScrape(args []string) error {
+	fs := newFlagSet("scrape")
+	name := fs.String("target", "", "name of the target to scrape, defaults to the first one")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := simulate(); err != nil {
+		return err
+	}
+	t, err := loadTarget(*name)
+	if err != nil {
+		return err
+	}
+	smp, err := scrapeTarget(context.Background(), http.DefaultClient, t)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	// Targets of other decoders have no metric.Metric to print.
+	if _, ok := t.decoder.(legacyDecoder); ok {
+		return enc.Encode(metricFromSample(smp))
 	}
+	return enc.Encode(smp)
 }
 
 func listenPort() string {
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	gaugeType   = "gauge"
+	counterType = "counter"
+)
+
+// metricDesc describes a named value of the samples.
+type metricDesc struct {
+	Name string `json:"name"`
+	// Type is gauge, or counter for values that only grow until the app
+	// restarts.
+	Type string `json:"type"`
+	Unit string `json:"unit,omitempty"`
+	Help string `json:"help,omitempty"`
+}
+
+// performanceIndexMetrics describe the metric.PerformanceIndex fields, in
+// the order they are charted.
+var performanceIndexMetrics = []metricDesc{
+	{Name: "FailRatio", Type: gaugeType, Unit: "ratio", Help: "Share of failed requests."},
+	{Name: "FailAmount", Type: counterType, Unit: "requests", Help: "Failed requests."},
+	{Name: "AccessAmount", Type: counterType, Unit: "requests", Help: "Served requests."},
+	{Name: "MaxConcurrent", Type: gaugeType, Unit: "requests", Help: "Maximum concurrent requests."},
+	{Name: "MinLatency", Type: gaugeType, Unit: "ms", Help: "Minimum request latency."},
+	{Name: "AvgLatency", Type: gaugeType, Unit: "ms", Help: "Average request latency."},
+}
+
+func performanceIndexMetric(name string) (metricDesc, bool) {
+	for _, d := range performanceIndexMetrics {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return metricDesc{}, false
+}
+
+// splitSeries splits a value name such as http_requests_total{code="200"}
+// into the metric name and its labels.
+func splitSeries(key string) (string, map[string]string) {
+	i := strings.IndexByte(key, '{')
+	if i < 0 || !strings.HasSuffix(key, "}") {
+		return key, nil
+	}
+	pairs, err := parsePrometheusLabels(key[i+1 : len(key)-1])
+	if err != nil {
+		return key, nil
+	}
+	labels := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		eq := strings.IndexByte(p, '=')
+		if v, err := strconv.Unquote(p[eq+1:]); err == nil {
+			labels[p[:eq]] = v
+		}
+	}
+	return key[:i], labels
+}
+
+// descRegistry remembers the metric descriptions decoders find in the
+// payloads of every target, such as Prometheus TYPE and HELP lines.
+type descRegistry struct {
+	mu       sync.RWMutex
+	byTarget map[string]map[string]metricDesc
+}
+
+var metricDescs = &descRegistry{byTarget: map[string]map[string]metricDesc{}}
+
+func (r *descRegistry) update(target string, descs []metricDesc) {
+	if len(descs) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.byTarget[target]
+	if !ok {
+		m = map[string]metricDesc{}
+		r.byTarget[target] = m
+	}
+	for _, d := range descs {
+		m[d.Name] = d
+	}
+}
+
+// describe returns the description of a value of t. The target config takes
+// precedence over what the payload declared, which takes precedence over
+// the PerformanceIndex defaults. Anything else is an untyped gauge.
+func (r *descRegistry) describe(t target, key string) metricDesc {
+	name, _ := splitSeries(key)
+	for _, d := range t.Metrics {
+		if d.Name == name || d.Name == key {
+			return d
+		}
+	}
+	r.mu.RLock()
+	d, ok := r.byTarget[t.Name][name]
+	r.mu.RUnlock()
+	if ok {
+		return d
+	}
+	if d, ok := performanceIndexMetric(name); ok {
+		return d
+	}
+	return metricDesc{Name: name, Type: gaugeType}
+}
+
+// valueNames returns the value names of s in chart order: the performance
+// index fields first, then the others sorted.
+func valueNames(s sample) []string {
+	var names, others []string
+	for _, d := range performanceIndexMetrics {
+		if _, ok := s.Values[d.Name]; ok {
+			names = append(names, d.Name)
+		}
+	}
+	for name := range s.Values {
+		if _, ok := performanceIndexMetric(name); !ok {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
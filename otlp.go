@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// otlpConfig configures the OpenTelemetry OTLP/HTTP metrics exporter.
+type otlpConfig struct {
+	URL string
+	// Encoding is protobuf or json.
+	Encoding string
+	// Headers are sent with every request, such as an Authorization token.
+	Headers map[string]string
+	queueConfig
+}
+
+// otlpResourceLabels map the sample labels describing where a value comes
+// from to the resource attributes of the OpenTelemetry semantic
+// conventions. The namespace, pod and node labels are usually static labels
+// of the target in CONFIG_FILE, since the agent runs in a pod of its own. The
+// other labels are attributes of the data points.
+var otlpResourceLabels = map[string]string{
+	"app":       "service.name",
+	"domain":    "service.namespace",
+	"host":      "host.name",
+	"namespace": "k8s.namespace.name",
+	"pod":       "k8s.pod.name",
+	"node":      "k8s.node.name",
+}
+
+// newOTLPExporter returns an exporter sending every sample to an
+// OpenTelemetry collector, such as http://collector:4318/v1/metrics.
+func newOTLPExporter(cfg otlpConfig) (*queueExporter, error) {
+	return newQueueExporter("otlp", cfg.URL, cfg.queueConfig, func(batch []exportSample) ([]byte, http.Header) {
+		req := newOTLPRequest(batch)
+		header := http.Header{}
+		for k, v := range cfg.Headers {
+			header.Set(k, v)
+		}
+		if cfg.Encoding == "json" {
+			body, err := json.Marshal(req)
+			if err != nil {
+				logger.Error("encoding OTLP request failed", "error", err)
+			}
+			header.Set("Content-Type", "application/json")
+			return body, header
+		}
+		header.Set("Content-Type", "application/x-protobuf")
+		return req.encode(), header
+	})
+}
+
+// otlpRequest is an ExportMetricsServiceRequest. The JSON tags follow the
+// OTLP/JSON mapping of the protocol buffer fields.
+type otlpRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+// otlpMetric holds either a gauge or, for counters, a cumulative monotonic
+// sum. The start time of the sums is left unset, as the agent does not know
+// when the app started counting.
+type otlpMetric struct {
+	Name  string     `json:"name"`
+	Unit  string     `json:"unit,omitempty"`
+	Gauge *otlpGauge `json:"gauge,omitempty"`
+	Sum   *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+	// AggregationTemporality is 2, cumulative.
+	AggregationTemporality int  `json:"aggregationTemporality"`
+	IsMonotonic            bool `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	TimeUnixNano uint64         `json:"timeUnixNano,string"`
+	AsDouble     float64        `json:"asDouble"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+// newOTLPRequest groups samples by resource, then by metric, keeping their
+// order.
+func newOTLPRequest(samples []exportSample) *otlpRequest {
+	req := &otlpRequest{}
+	resources := map[string]*otlpResourceMetrics{}
+	metrics := map[string]*otlpMetric{}
+	for _, s := range samples {
+		var name string
+		var resource, attributes []otlpKeyValue
+		for _, l := range s.Labels {
+			switch key, ok := otlpResourceLabels[l.Name]; {
+			case l.Name == "__name__":
+				name = l.Value
+			case len(l.Value) == 0:
+			case ok:
+				resource = append(resource, otlpString(key, l.Value))
+			default:
+				attributes = append(attributes, otlpString(l.Name, l.Value))
+			}
+		}
+		parts := make([]string, len(resource))
+		for i, a := range resource {
+			parts[i] = a.Key + "=" + a.Value.StringValue
+		}
+		rkey := strings.Join(parts, "\xff")
+		rm, ok := resources[rkey]
+		if !ok {
+			rm = &otlpResourceMetrics{
+				Resource:     otlpResource{Attributes: resource},
+				ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "k8s-app-monitor-agent"}}},
+			}
+			resources[rkey] = rm
+			req.ResourceMetrics = append(req.ResourceMetrics, rm)
+		}
+		mkey := rkey + "\xfe" + name + "\xff" + s.Type + "\xff" + s.Unit
+		m, ok := metrics[mkey]
+		if !ok {
+			m = &otlpMetric{Name: name, Unit: s.Unit}
+			if s.Type == counterType {
+				m.Sum = &otlpSum{AggregationTemporality: 2, IsMonotonic: true}
+			} else {
+				m.Gauge = &otlpGauge{}
+			}
+			metrics[mkey] = m
+			rm.ScopeMetrics[0].Metrics = append(rm.ScopeMetrics[0].Metrics, m)
+		}
+		p := otlpDataPoint{Attributes: attributes, TimeUnixNano: uint64(s.Timestamp) * 1e6, AsDouble: s.Value}
+		if m.Sum != nil {
+			m.Sum.DataPoints = append(m.Sum.DataPoints, p)
+		} else {
+			m.Gauge.DataPoints = append(m.Gauge.DataPoints, p)
+		}
+	}
+	return req
+}
+
+// encode encodes r as an ExportMetricsServiceRequest protocol buffer.
+func (r *otlpRequest) encode() []byte {
+	attributes := func(b *protoBuffer, field int, kvs []otlpKeyValue) {
+		for _, kv := range kvs {
+			var vb, kb protoBuffer
+			vb.string(1, kv.Value.StringValue)
+			kb.string(1, kv.Key)
+			kb.bytes(2, vb)
+			b.bytes(field, kb)
+		}
+	}
+	dataPoints := func(b *protoBuffer, points []otlpDataPoint) {
+		for _, p := range points {
+			var pb protoBuffer
+			pb.fixed64(3, p.TimeUnixNano)
+			pb.double(4, p.AsDouble)
+			attributes(&pb, 7, p.Attributes)
+			b.bytes(1, pb)
+		}
+	}
+	var req protoBuffer
+	for _, rm := range r.ResourceMetrics {
+		var rb, resource protoBuffer
+		attributes(&resource, 1, rm.Resource.Attributes)
+		rb.bytes(1, resource)
+		for _, sm := range rm.ScopeMetrics {
+			var sb, scope protoBuffer
+			scope.string(1, sm.Scope.Name)
+			sb.bytes(1, scope)
+			for _, m := range sm.Metrics {
+				var mb protoBuffer
+				mb.string(1, m.Name)
+				if len(m.Unit) > 0 {
+					mb.string(3, m.Unit)
+				}
+				var data protoBuffer
+				if m.Sum != nil {
+					dataPoints(&data, m.Sum.DataPoints)
+					data.int64(2, int64(m.Sum.AggregationTemporality))
+					if m.Sum.IsMonotonic {
+						data.int64(3, 1)
+					}
+					mb.bytes(7, data)
+				} else {
+					dataPoints(&data, m.Gauge.DataPoints)
+					mb.bytes(5, data)
+				}
+				sb.bytes(2, mb)
+			}
+			rb.bytes(2, sb)
+		}
+		req.bytes(1, rb)
+	}
+	return req
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// decodeOTLPRequest decodes the protocol buffer of otlpRequest.encode.
+func decodeOTLPRequest(t *testing.T, data []byte) *otlpRequest {
+	attributes := func(kvs [][]byte) []otlpKeyValue {
+		var attrs []otlpKeyValue
+		for _, kv := range kvs {
+			f := protoFields(t, kv)
+			attrs = append(attrs, otlpString(string(f[1][0]), string(protoFields(t, f[2][0])[1][0])))
+		}
+		return attrs
+	}
+	dataPoints := func(points [][]byte) []otlpDataPoint {
+		var dps []otlpDataPoint
+		for _, p := range points {
+			f := protoFields(t, p)
+			dps = append(dps, otlpDataPoint{
+				Attributes:   attributes(f[7]),
+				TimeUnixNano: binary.LittleEndian.Uint64(f[3][0]),
+				AsDouble:     math.Float64frombits(binary.LittleEndian.Uint64(f[4][0])),
+			})
+		}
+		return dps
+	}
+	req := &otlpRequest{}
+	for _, rm := range protoFields(t, data)[1] {
+		rf := protoFields(t, rm)
+		r := &otlpResourceMetrics{Resource: otlpResource{Attributes: attributes(protoFields(t, rf[1][0])[1])}}
+		for _, sm := range rf[2] {
+			sf := protoFields(t, sm)
+			s := otlpScopeMetrics{Scope: otlpScope{Name: string(protoFields(t, sf[1][0])[1][0])}}
+			for _, mm := range sf[2] {
+				mf := protoFields(t, mm)
+				m := &otlpMetric{Name: string(mf[1][0])}
+				if len(mf[3]) > 0 {
+					m.Unit = string(mf[3][0])
+				}
+				if len(mf[7]) > 0 {
+					df := protoFields(t, mf[7][0])
+					temporality, _ := binary.Uvarint(df[2][0])
+					m.Sum = &otlpSum{DataPoints: dataPoints(df[1]), AggregationTemporality: int(temporality), IsMonotonic: len(df[3]) > 0}
+				} else {
+					m.Gauge = &otlpGauge{DataPoints: dataPoints(protoFields(t, mf[5][0])[1])}
+				}
+				s.Metrics = append(s.Metrics, m)
+			}
+			r.ScopeMetrics = append(r.ScopeMetrics, s)
+		}
+		req.ResourceMetrics = append(req.ResourceMetrics, r)
+	}
+	return req
+}
+
+// otlpCollector is an OTLP/HTTP endpoint failing the first request.
+type otlpCollector struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	requests int
+	received []*otlpRequest
+}
+
+func (c *otlpCollector) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+	if c.requests == 1 {
+		http.Error(res, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if req.URL.Path != "/v1/metrics" || req.Header.Get("Authorization") != "Bearer secret" {
+		http.Error(res, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	switch req.Header.Get("Content-Type") {
+	case "application/json":
+		r := &otlpRequest{}
+		if err := json.Unmarshal(body, r); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.received = append(c.received, r)
+	case "application/x-protobuf":
+		c.received = append(c.received, decodeOTLPRequest(c.t, body))
+	default:
+		http.Error(res, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
+func TestOTLP(t *testing.T) {
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	ns := uint64(start.UnixNano())
+	resource := []otlpKeyValue{
+		otlpString("service.name", "orders"), otlpString("service.namespace", "shop"), otlpString("host.name", "node-1"),
+		otlpString("k8s.namespace.name", "shop"), otlpString("k8s.pod.name", "orders-7d4b9"),
+	}
+	points := func(attributes []otlpKeyValue, values ...float64) []otlpDataPoint {
+		var dps []otlpDataPoint
+		for i, v := range values {
+			dps = append(dps, otlpDataPoint{Attributes: attributes, TimeUnixNano: ns + uint64(i)*1e9, AsDouble: v})
+		}
+		return dps
+	}
+	tg := []otlpKeyValue{otlpString("target", "orders")}
+	want := &otlpRequest{ResourceMetrics: []*otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: resource},
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "k8s-app-monitor-agent"}, Metrics: []*otlpMetric{
+			{Name: "AccessAmount", Unit: "requests", Sum: &otlpSum{DataPoints: points(tg, 10, 20), AggregationTemporality: 2, IsMonotonic: true}},
+			{Name: "AvgLatency", Unit: "ms", Gauge: &otlpGauge{DataPoints: points(tg, 48, 52)}},
+			{Name: "queue_depth", Gauge: &otlpGauge{DataPoints: points([]otlpKeyValue{otlpString("queue", "mail"), otlpString("target", "orders")}, 3, 4)}},
+		}}},
+	}}}
+
+	for _, encoding := range []string{"protobuf", "json"} {
+		c := &otlpCollector{t: t}
+		server := httptest.NewServer(c)
+		o, err := newOTLPExporter(otlpConfig{
+			URL:         server.URL + "/v1/metrics",
+			Encoding:    encoding,
+			Headers:     map[string]string{"Authorization": "Bearer secret"},
+			queueConfig: queueConfig{BatchSize: 10, Capacity: 10, FlushInterval: time.Hour, Timeout: time.Second},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.minBackoff, o.maxBackoff = time.Millisecond, time.Millisecond
+		for i := 0; i < 2; i++ {
+			o.export(target{Name: "orders"}, sample{
+				Time:   start.Add(time.Duration(i) * time.Second),
+				Labels: map[string]string{"app": "orders", "domain": "shop", "host": "node-1", "namespace": "shop", "pod": "orders-7d4b9"},
+				Values: map[string]float64{"AccessAmount": float64(10 * (i + 1)), "AvgLatency": float64(48 + 4*i), `queue_depth{queue="mail"}`: float64(3 + i)},
+			})
+		}
+		if err := o.close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+		if c.requests != 2 || len(c.received) != 1 {
+			t.Fatalf("%s: received %d requests of %d, want 1 of 2", encoding, len(c.received), c.requests)
+		}
+		if got := c.received[0]; !reflect.DeepEqual(got, want) {
+			g, _ := json.Marshal(got)
+			w, _ := json.Marshal(want)
+			t.Errorf("%s request =\n%s\nwant\n%s", encoding, g, w)
+		}
+	}
+}
+
+func TestOTLPResources(t *testing.T) {
+	at := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	var samples []exportSample
+	for _, tg := range []target{
+		{Name: "orders", Labels: map[string]string{"namespace": "shop", "pod": "orders-7d4b9", "node": "node-1"}},
+		{Name: "search", Labels: map[string]string{"namespace": "web", "pod": "search-5c8f2", "node": "node-2"}},
+	} {
+		smp := stampSample(tg, sample{Labels: map[string]string{}, Values: map[string]float64{"AvgLatency": 48}}, at)
+		samples = append(samples, exportSamples(tg, smp)...)
+	}
+	req := newOTLPRequest(samples)
+	if len(req.ResourceMetrics) != 2 {
+		t.Fatalf("%d resources, want one per target", len(req.ResourceMetrics))
+	}
+	for i, want := range [][]otlpKeyValue{
+		{otlpString("service.name", "orders"), otlpString("k8s.namespace.name", "shop"), otlpString("k8s.node.name", "node-1"), otlpString("k8s.pod.name", "orders-7d4b9")},
+		{otlpString("service.name", "search"), otlpString("k8s.namespace.name", "web"), otlpString("k8s.node.name", "node-2"), otlpString("k8s.pod.name", "search-5c8f2")},
+	} {
+		if got := req.ResourceMetrics[i].Resource.Attributes; !reflect.DeepEqual(got, want) {
+			t.Errorf("resource %d = %v, want %v", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	chart "github.com/wcharczuk/go-chart"
+)
+
+// percentiles are the quantiles distributions report.
+var percentiles = []float64{0.5, 0.9, 0.99}
+
+// histogramBins is how many equal width bins sample values are counted in.
+const histogramBins = 20
+
+// bucket counts the observations up to an upper bound and above the bound of
+// the bucket before it.
+type bucket struct {
+	LE    string  `json:"le"`
+	Count float64 `json:"count"`
+
+	upper float64
+}
+
+// distribution summarizes the values of a field over a window.
+type distribution struct {
+	Field string `json:"field"`
+	Unit  string `json:"unit,omitempty"`
+	// Source is buckets when the target exposes a histogram of the field,
+	// or samples when the distribution is estimated from sample values.
+	Source      string             `json:"source"`
+	Count       float64            `json:"count"`
+	Percentiles map[string]float64 `json:"percentiles"`
+	// Hosts holds the percentiles of the samples of every pod, by host
+	// label, for distributions of sample values.
+	Hosts   map[string]map[string]float64 `json:"hosts,omitempty"`
+	Buckets []bucket                      `json:"buckets"`
+}
+
+// percentileName names a quantile, e.g. p99 for 0.99.
+func percentileName(q float64) string {
+	return "p" + strconv.FormatFloat(q*100, 'f', -1, 64)
+}
+
+// quantile returns the q quantile of sorted values, interpolating linearly
+// between the closest ranks.
+func quantile(q float64, sorted []float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	rank := q * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	if lo+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lo] + (sorted[lo+1]-sorted[lo])*(rank-float64(lo))
+}
+
+// bucketQuantile returns the q quantile of buckets sorted by upper bound,
+// interpolating linearly within the bucket it falls in like Prometheus'
+// histogram_quantile. A quantile in the +Inf bucket is the highest finite
+// bound.
+func bucketQuantile(q float64, buckets []bucket) float64 {
+	var total float64
+	for _, b := range buckets {
+		total += b.Count
+	}
+	if total == 0 {
+		return math.NaN()
+	}
+	rank := q * total
+	var lower, seen float64
+	for i, b := range buckets {
+		if seen+b.Count >= rank && b.Count > 0 {
+			if math.IsInf(b.upper, 1) {
+				if i > 0 {
+					return buckets[i-1].upper
+				}
+				return math.NaN()
+			}
+			return lower + (b.upper-lower)*(rank-seen)/b.Count
+		}
+		seen += b.Count
+		lower = b.upper
+	}
+	return lower
+}
+
+// sampleDistribution estimates the distribution of field from the values of
+// samples, counted in equal width bins.
+func sampleDistribution(field string, samples []sample) distribution {
+	d := distribution{Field: field, Source: "samples", Percentiles: map[string]float64{}}
+	var values []float64
+	byHost := map[string][]float64{}
+	for _, s := range samples {
+		if v, ok := s.Values[field]; ok {
+			values = append(values, v)
+			if host, ok := s.Labels["host"]; ok {
+				byHost[host] = append(byHost[host], v)
+			}
+		}
+	}
+	if len(values) == 0 {
+		return d
+	}
+	sort.Float64s(values)
+	d.Count = float64(len(values))
+	for _, q := range percentiles {
+		d.Percentiles[percentileName(q)] = quantile(q, values)
+	}
+	if len(byHost) > 1 {
+		d.Hosts = map[string]map[string]float64{}
+		for host, hv := range byHost {
+			sort.Float64s(hv)
+			d.Hosts[host] = map[string]float64{}
+			for _, q := range percentiles {
+				d.Hosts[host][percentileName(q)] = quantile(q, hv)
+			}
+		}
+	}
+
+	min, max := values[0], values[len(values)-1]
+	n := histogramBins
+	if min == max {
+		n = 1
+	}
+	width := (max - min) / float64(n)
+	for i := 0; i < n; i++ {
+		upper := min + width*float64(i+1)
+		if i == n-1 {
+			upper = max
+		}
+		d.Buckets = append(d.Buckets, bucket{LE: formatFloat(upper), upper: upper})
+	}
+	for _, v := range values {
+		i := n - 1
+		if width > 0 {
+			i = int((v - min) / width)
+		}
+		if i >= n {
+			i = n - 1
+		}
+		d.Buckets[i].Count++
+	}
+	return d
+}
+
+// hasBuckets reports whether samples hold Prometheus histogram buckets of
+// field, i.e. <field>_bucket{le="..."} counters.
+func hasBuckets(field string, samples []sample) bool {
+	for _, s := range samples {
+		for key := range s.Values {
+			if name, labels := splitSeries(key); name == field+"_bucket" && len(labels["le"]) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bucketDistribution reads the distribution of field from the histogram
+// buckets of samples: the bucket increases over the window, summed over the
+// other labels, or the counts since the app started when the window holds a
+// single sample.
+func bucketDistribution(field string, samples []sample) distribution {
+	d := distribution{Field: field, Source: "buckets", Percentiles: map[string]float64{}}
+	bounds := func(s sample) map[string]float64 {
+		cumulative := map[string]float64{}
+		for key, v := range s.Values {
+			if name, labels := splitSeries(key); name == field+"_bucket" {
+				if _, ok := labels["le"]; ok {
+					cumulative[key] = v
+				}
+			}
+		}
+		return cumulative
+	}
+	increases := map[string]float64{}
+	for i := 1; i < len(samples); i++ {
+		prev := bounds(samples[i-1])
+		for key, v := range bounds(samples[i]) {
+			if p, ok := prev[key]; ok {
+				increases[key] += counterIncrease(p, v)
+			}
+		}
+	}
+	var total float64
+	for _, v := range increases {
+		total += v
+	}
+	if total == 0 && len(samples) > 0 {
+		increases = bounds(samples[len(samples)-1])
+	}
+
+	cumulative := map[float64]float64{}
+	for key, v := range increases {
+		_, labels := splitSeries(key)
+		upper, err := parsePrometheusValue(labels["le"])
+		if err != nil {
+			continue
+		}
+		cumulative[upper] += v
+	}
+	uppers := make([]float64, 0, len(cumulative))
+	for upper := range cumulative {
+		uppers = append(uppers, upper)
+	}
+	sort.Float64s(uppers)
+	var seen float64
+	for _, upper := range uppers {
+		// Buckets are cumulative, charts and quantiles want them apart.
+		count := math.Max(cumulative[upper]-seen, 0)
+		seen = math.Max(seen, cumulative[upper])
+		d.Buckets = append(d.Buckets, bucket{LE: formatFloat(upper), Count: count, upper: upper})
+		d.Count += count
+	}
+	for _, q := range percentiles {
+		if v := bucketQuantile(q, d.Buckets); !math.IsNaN(v) {
+			d.Percentiles[percentileName(q)] = v
+		}
+	}
+	return d
+}
+
+// fieldDistribution returns the distribution of field of t over samples,
+// from the buckets the target exposes if any.
+func fieldDistribution(t target, field string, samples []sample) distribution {
+	var d distribution
+	if hasBuckets(field, samples) {
+		d = bucketDistribution(field, samples)
+	} else {
+		d = sampleDistribution(field, samples)
+	}
+	d.Unit = metricDescs.describe(t, field).Unit
+	return d
+}
+
+// renderHistogramChart draws the buckets of a distribution, with its
+// percentiles in the title.
+func renderHistogramChart(w io.Writer, title string, d distribution, opts chartOptions) error {
+	if d.Count == 0 {
+		return fmt.Errorf("no %s values to chart", d.Field)
+	}
+	inner := chart.ContinuousSeries{}
+	var ticks []chart.Tick
+	for i, b := range d.Buckets {
+		inner.XValues = append(inner.XValues, float64(i))
+		inner.YValues = append(inner.YValues, b.Count)
+		ticks = append(ticks, chart.Tick{Value: float64(i), Label: "≤" + formatTick(b.upper)})
+	}
+	xstyle := chart.Style{Show: true, TextRotationDegrees: 45}
+	if len(ticks) == 1 {
+		// The ticks span the X axis, which go-chart cannot scale to the single
+		// bucket of equal values, so unlabeled ones center it. go-chart draws
+		// nothing with rotated unlabeled ticks.
+		ticks = []chart.Tick{{Value: -1}, ticks[0], {Value: 1}}
+		xstyle.TextRotationDegrees = 0
+	}
+	var summary []string
+	for _, q := range percentiles {
+		if v, ok := d.Percentiles[percentileName(q)]; ok {
+			summary = append(summary, fmt.Sprintf("%s %s", percentileName(q), formatTick(v)))
+		}
+	}
+	if len(summary) > 0 {
+		title += ": " + strings.Join(summary, ", ")
+	}
+	c := chart.Chart{
+		Title:      title,
+		TitleStyle: chart.Style{Show: true},
+		Width:      opts.Width,
+		Height:     opts.Height,
+		XAxis: chart.XAxis{
+			Name:      axisName(d.Field, d.Unit),
+			NameStyle: chart.Style{Show: true},
+			Style:     xstyle,
+			Ticks:     ticks,
+		},
+		YAxis: chart.YAxis{
+			Name:      "count",
+			NameStyle: chart.Style{Show: true},
+			Style:     chart.Style{Show: true},
+		},
+		Series: []chart.Series{chart.HistogramSeries{
+			Name:        d.Field,
+			Style:       chart.Style{Show: true, StrokeColor: chart.ColorBlue, FillColor: chart.ColorBlue.WithAlpha(160)},
+			InnerSeries: inner,
+		}},
+	}
+	return render(w, c, opts)
+}
+
+// formatTick formats a value with at most four significant digits.
+func formatTick(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', 4, 64)
+}
+
+// apiPercentiles serves the distribution of a field of a target over a
+// window.
+func apiPercentiles(cfg *config, s *store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		t, err := cfg.target(q.Get("target"))
+		if err != nil {
+			writeJSONError(res, http.StatusNotFound, err)
+			return
+		}
+		window, err := parseWindow(req, "window", time.Hour)
+		if err != nil {
+			writeJSONError(res, http.StatusBadRequest, err)
+			return
+		}
+		field := q.Get("field")
+		if len(field) == 0 {
+			field = "AvgLatency"
+		}
+		writeJSON(res, http.StatusOK, fieldDistribution(t, field, s.samplesSince(t.Name, time.Now().Add(-window))))
+	}
+}
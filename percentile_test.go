@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSampleDistribution(t *testing.T) {
+	var samples []sample
+	for i := 1; i <= 101; i++ {
+		host := "pod-a"
+		if i%2 == 0 {
+			host = "pod-b"
+		}
+		samples = append(samples, sample{
+			Labels: map[string]string{"host": host},
+			Values: map[string]float64{"AvgLatency": float64(i)},
+		})
+	}
+	d := sampleDistribution("AvgLatency", samples)
+	for name, want := range map[string]float64{"p50": 51, "p90": 91, "p99": 100} {
+		if got := d.Percentiles[name]; math.Abs(got-want) > 1e-9 {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+	if len(d.Hosts) != 2 {
+		t.Errorf("got percentiles of %d hosts, want 2", len(d.Hosts))
+	}
+	var count float64
+	for _, b := range d.Buckets {
+		count += b.Count
+	}
+	if len(d.Buckets) != histogramBins || count != 101 {
+		t.Errorf("got %d buckets holding %v values, want %d holding 101", len(d.Buckets), count, histogramBins)
+	}
+}
+
+func TestHistogramOfEqualValues(t *testing.T) {
+	var samples []sample
+	for i := 0; i < 5; i++ {
+		samples = append(samples, sample{Values: map[string]float64{"AvgLatency": 48}})
+	}
+	d := sampleDistribution("AvgLatency", samples)
+	if len(d.Buckets) != 1 || d.Buckets[0].Count != 5 {
+		t.Fatalf("buckets = %v, want one holding 5 values", d.Buckets)
+	}
+	for _, format := range []string{"png", "svg"} {
+		var buf bytes.Buffer
+		if err := renderHistogramChart(&buf, "test-app AvgLatency", d, chartOptions{Format: format, Width: 512, Height: 256}); err != nil || buf.Len() == 0 {
+			t.Errorf("rendering a %s histogram of equal values: %v", format, err)
+		}
+	}
+}
+
+func TestBucketDistribution(t *testing.T) {
+	payload := func(counts ...float64) sample {
+		var lines []string
+		for i, le := range []string{"0.1", "0.5", "1", "+Inf"} {
+			lines = append(lines, fmt.Sprintf("request_duration_seconds_bucket{le=%q} %v", le, counts[i]))
+		}
+		s, _, err := prometheusDecoder{}.decode(strings.NewReader(strings.Join(lines, "\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	first, last := payload(1000, 1000, 1000, 1000), payload(1050, 1090, 1100, 1100)
+	first.Time, last.Time = start, start.Add(time.Minute)
+	samples := []sample{first, last}
+
+	if !hasBuckets("request_duration_seconds", samples) {
+		t.Fatal("buckets not found")
+	}
+	d := bucketDistribution("request_duration_seconds", samples)
+	if d.Count != 100 {
+		t.Errorf("count = %v, want the 100 observations of the window", d.Count)
+	}
+	// 50 observations up to 0.1, 40 up to 0.5 and 10 up to 1.
+	for name, want := range map[string]float64{"p50": 0.1, "p90": 0.5, "p99": 0.95} {
+		if got := d.Percentiles[name]; math.Abs(got-want) > 1e-9 {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+}
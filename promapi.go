@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Prometheus HTTP API over the stored samples, as much of it as a Grafana
+// Prometheus data source needs: instant and range queries in the query
+// language of query.go, and the label and series lookups behind its query
+// editor and template variables. See
+// https://prometheus.io/docs/prometheus/latest/querying/api/.
+
+// promResponse is the envelope of every answer.
+type promResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+func writePromData(res http.ResponseWriter, data interface{}) {
+	writeJSON(res, http.StatusOK, promResponse{Status: "success", Data: data})
+}
+
+// writePromError answers with bad_data for invalid parameters and queries,
+// and execution for queries that fail to evaluate.
+func writePromError(res http.ResponseWriter, err error) {
+	status, errorType := http.StatusBadRequest, "bad_data"
+	switch err.(type) {
+	case promParamError, queryError:
+	default:
+		status, errorType = http.StatusUnprocessableEntity, "execution"
+	}
+	writeJSON(res, status, promResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+}
+
+// promParamError is an invalid request parameter.
+type promParamError struct {
+	err error
+}
+
+func (e promParamError) Error() string {
+	return e.err.Error()
+}
+
+// promValue is a value at a time, encoded as [unix seconds, "value"].
+type promValue struct {
+	T time.Time
+	V float64
+}
+
+func (v promValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{
+		json.Number(strconv.FormatFloat(float64(v.T.UnixNano()/int64(time.Millisecond))/1e3, 'f', -1, 64)),
+		formatPromFloat(v.V),
+	})
+}
+
+func formatPromFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+type promVectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  promValue         `json:"value"`
+}
+
+type promMatrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values []promValue       `json:"values"`
+}
+
+type promQueryData struct {
+	ResultType string      `json:"resultType"`
+	Result     interface{} `json:"result"`
+}
+
+// promMetric returns the labels of s with its name as __name__, which
+// functions and arithmetic drop.
+func promMetric(s evalSeries) map[string]string {
+	metric := make(map[string]string, len(s.labels)+1)
+	for k, v := range s.labels {
+		metric[k] = v
+	}
+	if len(s.name) > 0 {
+		metric["__name__"] = s.name
+	}
+	return metric
+}
+
+// parsePromTime reads a time parameter in unix seconds or RFC 3339.
+func parsePromTime(req *http.Request, name string, def time.Time) (time.Time, error) {
+	v := req.FormValue(name)
+	if len(v) == 0 {
+		return def, nil
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e3))*int64(time.Millisecond)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	return time.Time{}, promParamError{fmt.Errorf("invalid %s %q", name, v)}
+}
+
+// parsePromStep reads the step parameter as a duration such as 15s, or in
+// seconds.
+func parsePromStep(req *http.Request) (time.Duration, error) {
+	v := req.FormValue("step")
+	if d, err := parseDuration(v); err == nil && d > 0 {
+		return d, nil
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	return 0, promParamError{fmt.Errorf("invalid step %q, want a positive duration", v)}
+}
+
+// apiPromQuery serves /api/v1/query, the value of a query at time, default
+// now.
+func apiPromQuery(q *queryEngine) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		at, err := parsePromTime(req, "time", time.Now())
+		if err != nil {
+			writePromError(res, err)
+			return
+		}
+		r, err := q.evalQuery(req.FormValue("query"), []time.Time{at})
+		if err != nil {
+			writePromError(res, err)
+			return
+		}
+		if r.scalar != nil {
+			writePromData(res, promQueryData{"scalar", promValue{at, r.scalar[0]}})
+			return
+		}
+		result := []promVectorSample{}
+		for _, s := range r.series {
+			if !math.IsNaN(s.values[0]) {
+				result = append(result, promVectorSample{promMetric(s), promValue{at, s.values[0]}})
+			}
+		}
+		writePromData(res, promQueryData{"vector", result})
+	}
+}
+
+// apiPromQueryRange serves /api/v1/query_range, the values of a query from
+// start to end at every step.
+func apiPromQueryRange(q *queryEngine) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		start, err := parsePromTime(req, "start", time.Time{})
+		if err != nil {
+			writePromError(res, err)
+			return
+		}
+		end, err := parsePromTime(req, "end", time.Time{})
+		if err != nil {
+			writePromError(res, err)
+			return
+		}
+		if start.IsZero() || end.IsZero() || end.Before(start) {
+			writePromError(res, promParamError{errors.New("start and end are required, end not before start")})
+			return
+		}
+		step, err := parsePromStep(req)
+		if err != nil {
+			writePromError(res, err)
+			return
+		}
+		steps, err := querySteps(end, end.Sub(start), step)
+		if err != nil {
+			writePromError(res, promParamError{err})
+			return
+		}
+		r, err := q.evalQuery(req.FormValue("query"), steps)
+		if err != nil {
+			writePromError(res, err)
+			return
+		}
+		if r.scalar != nil {
+			r.series = []evalSeries{{labels: map[string]string{}, values: r.scalar}}
+		}
+		result := []promMatrixSeries{}
+		for _, s := range r.series {
+			ms := promMatrixSeries{Metric: promMetric(s)}
+			for i, v := range s.values {
+				if !math.IsNaN(v) {
+					ms.Values = append(ms.Values, promValue{steps[i], v})
+				}
+			}
+			if len(ms.Values) > 0 {
+				result = append(result, ms)
+			}
+		}
+		writePromData(res, promQueryData{"matrix", result})
+	}
+}
+
+// promSeries returns the label sets, with __name__, of the series stored
+// between the start and end parameters, all time by default, that a
+// selector in match[] selects, or of every series without match[].
+func promSeries(q *queryEngine, req *http.Request) ([]map[string]string, error) {
+	start, err := parsePromTime(req, "start", time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	end, err := parsePromTime(req, "end", time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := req.ParseForm(); err != nil {
+		return nil, promParamError{err}
+	}
+	var selectors []*selectorExpr
+	for _, m := range req.Form["match[]"] {
+		e, err := parseQuery(m)
+		if err != nil {
+			return nil, err
+		}
+		sel, ok := e.(*selectorExpr)
+		if !ok {
+			return nil, promParamError{fmt.Errorf("match[] %s is not a series selector", m)}
+		}
+		selectors = append(selectors, sel)
+	}
+	if len(selectors) == 0 {
+		selectors = []*selectorExpr{{}}
+	}
+	seen := map[string]bool{}
+	var result []map[string]string
+	for _, sel := range selectors {
+		for _, raw := range q.selectRaw(sel, start, end) {
+			metric := promMetric(evalSeries{name: raw.name, labels: raw.labels})
+			if key := labelSetKey(metric); !seen[key] {
+				seen[key] = true
+				result = append(result, metric)
+			}
+		}
+	}
+	return result, nil
+}
+
+// apiPromSeries serves /api/v1/series, the label sets of the series match[]
+// selects.
+func apiPromSeries(q *queryEngine) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			writePromError(res, promParamError{err})
+			return
+		}
+		if len(req.Form["match[]"]) == 0 {
+			writePromError(res, promParamError{errors.New("no match[] parameter provided")})
+			return
+		}
+		series, err := promSeries(q, req)
+		if err != nil {
+			writePromError(res, err)
+			return
+		}
+		sort.Slice(series, func(i, j int) bool { return labelSetKey(series[i]) < labelSetKey(series[j]) })
+		if series == nil {
+			series = []map[string]string{}
+		}
+		writePromData(res, series)
+	}
+}
+
+// apiPromLabels serves /api/v1/labels, the sorted label names of the series.
+func apiPromLabels(q *queryEngine) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		series, err := promSeries(q, req)
+		if err != nil {
+			writePromError(res, err)
+			return
+		}
+		names := map[string]bool{}
+		for _, metric := range series {
+			for k := range metric {
+				names[k] = true
+			}
+		}
+		writePromData(res, sortedSet(names))
+	}
+}
+
+// apiPromLabelValues serves /api/v1/label/<name>/values, the sorted values
+// of a label over the series. The values of __name__ are the value names.
+func apiPromLabelValues(q *queryEngine) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		name := strings.TrimPrefix(req.URL.Path, "/api/v1/label/")
+		if !strings.HasSuffix(name, "/values") {
+			http.NotFound(res, req)
+			return
+		}
+		name = strings.TrimSuffix(name, "/values")
+		series, err := promSeries(q, req)
+		if err != nil {
+			writePromError(res, err)
+			return
+		}
+		values := map[string]bool{}
+		for _, metric := range series {
+			if v, ok := metric[name]; ok {
+				values[v] = true
+			}
+		}
+		writePromData(res, sortedSet(values))
+	}
+}
+
+func sortedSet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
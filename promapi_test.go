@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPromAPI(t *testing.T) {
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	cfg := &config{
+		Targets:        []target{{Name: "orders"}, {Name: "search"}},
+		ScrapeInterval: time.Minute,
+	}
+	s, _ := newStore(100, "")
+	for i := 0; i <= 10; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		s.add("orders", sample{
+			Time:   at,
+			Labels: map[string]string{"app": "orders"},
+			Values: map[string]float64{"AccessAmount": float64(i) * 60, "AvgLatency": 20},
+		})
+		s.add("search", sample{
+			Time:   at,
+			Labels: map[string]string{"app": "search"},
+			Values: map[string]float64{"AvgLatency": 5},
+		})
+	}
+	q := newQueryEngine(cfg, s)
+
+	get := func(h http.HandlerFunc, path string, params url.Values, wantStatus int) interface{} {
+		t.Helper()
+		res := httptest.NewRecorder()
+		h(res, httptest.NewRequest("GET", path+"?"+params.Encode(), nil))
+		if res.Code != wantStatus {
+			t.Fatalf("%s?%s = %d %s, want %d", path, params.Encode(), res.Code, res.Body, wantStatus)
+		}
+		var body struct {
+			Status string
+			Data   interface{}
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Data
+	}
+	end := start.Add(10 * time.Minute)
+
+	data := get(apiPromQuery(q), "/api/v1/query", url.Values{
+		"query": {`AvgLatency{app="orders"}`},
+		"time":  {end.Format(time.RFC3339)},
+	}, http.StatusOK)
+	want := map[string]interface{}{
+		"resultType": "vector",
+		"result": []interface{}{map[string]interface{}{
+			"metric": map[string]interface{}{"__name__": "AvgLatency", "app": "orders", "target": "orders"},
+			"value":  []interface{}{float64(end.Unix()), "20"},
+		}},
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("query = %v, want %v", data, want)
+	}
+
+	data = get(apiPromQuery(q), "/api/v1/query", url.Values{"query": {"1 + 1"}, "time": {"1514808000.5"}}, http.StatusOK)
+	want = map[string]interface{}{"resultType": "scalar", "result": []interface{}{1514808000.5, "2"}}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("scalar query = %v, want %v", data, want)
+	}
+
+	data = get(apiPromQueryRange(q), "/api/v1/query_range", url.Values{
+		"query": {`rate(AccessAmount[5m])`},
+		"start": {start.Format(time.RFC3339)},
+		"end":   {end.Format(time.RFC3339)},
+		"step":  {"300"},
+	}, http.StatusOK)
+	want = map[string]interface{}{
+		"resultType": "matrix",
+		"result": []interface{}{map[string]interface{}{
+			"metric": map[string]interface{}{"app": "orders", "target": "orders"},
+			"values": []interface{}{
+				[]interface{}{float64(start.Add(5 * time.Minute).Unix()), "1"},
+				[]interface{}{float64(end.Unix()), "1"},
+			},
+		}},
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("query_range = %v, want %v", data, want)
+	}
+
+	data = get(apiPromLabels(q), "/api/v1/labels", nil, http.StatusOK)
+	if want := []interface{}{"__name__", "app", "target"}; !reflect.DeepEqual(data, want) {
+		t.Errorf("labels = %v, want %v", data, want)
+	}
+	data = get(apiPromLabelValues(q), "/api/v1/label/__name__/values", nil, http.StatusOK)
+	if want := []interface{}{"AccessAmount", "AvgLatency", "up"}; !reflect.DeepEqual(data, want) {
+		t.Errorf("__name__ values = %v, want %v", data, want)
+	}
+	data = get(apiPromLabelValues(q), "/api/v1/label/app/values", url.Values{"match[]": {"AccessAmount"}}, http.StatusOK)
+	if want := []interface{}{"orders"}; !reflect.DeepEqual(data, want) {
+		t.Errorf("app values = %v, want %v", data, want)
+	}
+	data = get(apiPromSeries(q), "/api/v1/series", url.Values{"match[]": {`{app="search"}`}}, http.StatusOK)
+	want2 := []interface{}{
+		map[string]interface{}{"__name__": "AvgLatency", "app": "search", "target": "search"},
+		map[string]interface{}{"__name__": "up", "app": "search", "target": "search"},
+	}
+	if !reflect.DeepEqual(data, want2) {
+		t.Errorf("series = %v, want %v", data, want2)
+	}
+
+	get(apiPromQuery(q), "/api/v1/query", url.Values{"query": {"AvgLatency{"}}, http.StatusBadRequest)
+	get(apiPromQueryRange(q), "/api/v1/query_range", url.Values{"query": {"AvgLatency"}, "start": {"10"}, "end": {"5"}, "step": {"1"}}, http.StatusBadRequest)
+	get(apiPromSeries(q), "/api/v1/series", nil, http.StatusBadRequest)
+	get(apiPromSeries(q), "/api/v1/series", url.Values{"match[]": {"rate(AccessAmount[5m])"}}, http.StatusBadRequest)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// protoBuffer appends protocol buffer fields, enough to encode the few
+// messages the exporters send without generated code.
+type protoBuffer []byte
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+func (b *protoBuffer) varint(v uint64) {
+	*b = append(*b, make([]byte, binary.MaxVarintLen64)...)
+	n := binary.PutUvarint((*b)[len(*b)-binary.MaxVarintLen64:], v)
+	*b = (*b)[:len(*b)-binary.MaxVarintLen64+n]
+}
+
+func (b *protoBuffer) tag(field, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+// bytes appends a length delimited field: a string, bytes or an encoded
+// message.
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.tag(field, protoBytes)
+	b.varint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+func (b *protoBuffer) string(field int, s string) {
+	b.tag(field, protoBytes)
+	b.varint(uint64(len(s)))
+	*b = append(*b, s...)
+}
+
+func (b *protoBuffer) double(field int, v float64) {
+	b.fixed64(field, math.Float64bits(v))
+}
+
+func (b *protoBuffer) fixed64(field int, v uint64) {
+	b.tag(field, protoFixed64)
+	*b = append(*b, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64((*b)[len(*b)-8:], v)
+}
+
+func (b *protoBuffer) int64(field int, v int64) {
+	b.tag(field, protoVarint)
+	b.varint(uint64(v))
+}
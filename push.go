@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// maxPushBytes bounds the body of a push request.
+const maxPushBytes = 1 << 20
+
+// apiPush stores the metric.Metric JSON pushed by apps that cannot be
+// scraped, such as batch jobs. The body is one metric or an array of them,
+// each recorded as a sample of the push target named after its app_name, or
+// labelled with it, exactly like a scraped sample. A batch is checked as a
+// whole before anything is stored.
+func apiPush(cfg *config, c *collector) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			res.Header().Set("Allow", "POST")
+			writeJSONError(res, http.StatusMethodNotAllowed, fmt.Errorf("push with POST"))
+			return
+		}
+		if len(cfg.PushToken) > 0 {
+			auth := []byte(req.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(auth, []byte("Bearer "+cfg.PushToken)) != 1 {
+				res.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSONError(res, http.StatusUnauthorized, fmt.Errorf("invalid push token"))
+				return
+			}
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, maxPushBytes))
+		if err != nil {
+			writeJSONError(res, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		var docs []json.RawMessage
+		if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+			if err := json.Unmarshal(body, &docs); err != nil {
+				writeJSONError(res, http.StatusBadRequest, decodeError{err})
+				return
+			}
+		} else {
+			docs = []json.RawMessage{body}
+		}
+
+		type push struct {
+			t   target
+			smp sample
+		}
+		var pushes []push
+		for i, doc := range docs {
+			smp, _, err := legacyDecoder{}.decode(bytes.NewReader(doc))
+			if err != nil {
+				writeJSONError(res, http.StatusBadRequest, fmt.Errorf("metric %d: %v", i, err))
+				return
+			}
+			app := smp.Labels["app"]
+			if len(app) == 0 {
+				writeJSONError(res, http.StatusBadRequest, fmt.Errorf("metric %d: missing app_name", i))
+				return
+			}
+			t, ok := pushTarget(cfg, app)
+			if !ok {
+				writeJSONError(res, http.StatusNotFound, fmt.Errorf("metric %d: no push target for app %q", i, app))
+				return
+			}
+			pushes = append(pushes, push{t, smp})
+		}
+		now := time.Now()
+		for _, p := range pushes {
+			c.push(p.t, stampSample(p.t, p.smp, now))
+		}
+		writeJSON(res, http.StatusOK, map[string]int{"accepted": len(pushes)})
+	}
+}
+
+// pushTarget returns the push target of an app: the one named after it, or
+// else the one with that app label.
+func pushTarget(cfg *config, app string) (target, bool) {
+	for _, t := range cfg.Targets {
+		if t.Push && t.Name == app {
+			return t, true
+		}
+	}
+	for _, t := range cfg.Targets {
+		if t.Push && t.Labels["app"] == app {
+			return t, true
+		}
+	}
+	return target{}, false
+}
+
+// latestPushed returns the last sample pushed to t, charted in place of a
+// scrape.
+func latestPushed(t target, s *store) (sample, error) {
+	smp, ok := s.latest(t.Name)
+	if !ok {
+		return sample{}, fmt.Errorf("nothing was pushed to target %s", t.Name)
+	}
+	if len(smp.Values) == 0 {
+		return sample{}, fmt.Errorf("target %s went stale at %s", t.Name, smp.Time.Format(time.RFC3339))
+	}
+	return smp, nil
+}
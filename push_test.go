@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPush(t *testing.T) {
+	cfg := &config{
+		Targets: []target{
+			{Name: "orders", URL: "http://orders:3000/metrics"},
+			{Name: "nightly-report", Push: true, staleAfter: 10 * time.Minute},
+			{Name: "billing", Push: true, Labels: map[string]string{"app": "billing-job", "team": "finance"}, staleAfter: time.Minute},
+		},
+		ScrapeInterval: time.Minute,
+		PushToken:      "secret",
+	}
+	s, _ := newStore(100, "")
+	c := newCollector(cfg, s, nil)
+	h := apiPush(cfg, c)
+	post := func(auth, body string, wantStatus int) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/push", strings.NewReader(body))
+		if len(auth) > 0 {
+			req.Header.Set("Authorization", auth)
+		}
+		res := httptest.NewRecorder()
+		h(res, req)
+		if res.Code != wantStatus {
+			t.Fatalf("pushing %s = %d %s, want %d", body, res.Code, res.Body, wantStatus)
+		}
+	}
+
+	one := `{"app_name": "nightly-report", "host": "job-1", "performance_index": {"accessAmount": 10, "avgLatency": 48}}`
+	post("", one, http.StatusUnauthorized)
+	post("Bearer wrong", one, http.StatusUnauthorized)
+	post("Bearer secret", `{"app_name": "orders"}`, http.StatusNotFound)
+	post("Bearer secret", `[`+one+`, {"host": "job-2"}]`, http.StatusBadRequest)
+	post("Bearer secret", `{"app_name": `, http.StatusBadRequest)
+	if n := s.occupancy(); len(n) != 0 {
+		t.Fatalf("rejected pushes stored %v", n)
+	}
+
+	post("Bearer secret", one, http.StatusOK)
+	post("Bearer secret", `[{"app_name": "billing-job", "performance_index": {"failAmount": 1}}, {"app_name": "nightly-report", "performance_index": {"accessAmount": 70}}]`, http.StatusOK)
+	report := s.samples("nightly-report")
+	if len(report) != 2 {
+		t.Fatalf("stored %d nightly-report samples, want 2", len(report))
+	}
+	if want := map[string]string{"app": "nightly-report", "host": "job-1"}; !reflect.DeepEqual(report[0].Labels, want) {
+		t.Errorf("labels = %v, want %v", report[0].Labels, want)
+	}
+	if _, ok := report[1].Values["AccessAmountRate"]; !ok {
+		t.Errorf("pushed counters have no derived rate: %v", report[1].Values)
+	}
+	billing, ok := s.latest("billing")
+	if !ok || billing.Labels["team"] != "finance" || billing.Values["FailAmount"] != 1 {
+		t.Errorf("billing sample = %+v", billing)
+	}
+
+	// billing goes stale first, and stays marked once.
+	now := billing.Time.Add(5 * time.Minute)
+	c.markStale(cfg.Targets[1], now)
+	c.markStale(cfg.Targets[2], now)
+	c.markStale(cfg.Targets[2], now.Add(time.Minute))
+	if _, err := latestPushed(cfg.Targets[1], s); err != nil {
+		t.Error(err)
+	}
+	if n := len(s.samples("billing")); n != 2 {
+		t.Errorf("stored %d billing samples, want the push and one stale marker", n)
+	}
+	marker, _ := s.latest("billing")
+	if len(marker.Values) != 0 || !marker.Time.Equal(now) || marker.Labels["team"] != "finance" {
+		t.Errorf("stale marker = %+v", marker)
+	}
+	if _, err := latestPushed(cfg.Targets[2], s); err == nil || !strings.Contains(err.Error(), "stale") {
+		t.Errorf("latestPushed of a stale target = %v, want a stale error", err)
+	}
+
+	// A new push revives the target.
+	post("Bearer secret", `{"app_name": "billing-job", "performance_index": {"failAmount": 2}}`, http.StatusOK)
+	if smp, err := latestPushed(cfg.Targets[2], s); err != nil || smp.Values["FailAmount"] != 2 {
+		t.Errorf("latestPushed after a new push = %+v, %v", smp, err)
+	}
+}
+
+func TestConcurrentPush(t *testing.T) {
+	tg := target{Name: "billing", Push: true, staleAfter: time.Nanosecond}
+	cfg := &config{Targets: []target{tg}, ScrapeInterval: time.Minute}
+	s, _ := newStore(1000, "")
+	c := newCollector(cfg, s, nil)
+	h := apiPush(cfg, c)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				req := httptest.NewRequest("POST", "/api/push", strings.NewReader(`[{"app_name": "billing", "performance_index": {"accessAmount": 1}}, {"app_name": "billing", "performance_index": {"accessAmount": 2}}]`))
+				h(httptest.NewRecorder(), req)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				c.markStale(tg, time.Now())
+			}
+		}()
+	}
+	wg.Wait()
+
+	samples := s.samples("billing")
+	pushes := 0
+	for i, smp := range samples {
+		if len(smp.Values) > 0 {
+			pushes++
+		}
+		if i > 0 && smp.Time.Before(samples[i-1].Time) {
+			t.Fatalf("sample %d at %v is older than the one before at %v", i, smp.Time, samples[i-1].Time)
+		}
+	}
+	if pushes != 8*20*2 {
+		t.Errorf("stored %d pushed samples, want %d", pushes, 8*20*2)
+	}
+
+	// An append older than the newest sample is stored at its time.
+	last, _ := s.latest("billing")
+	if smp := s.add("billing", sample{Time: last.Time.Add(-time.Hour)}); !smp.Time.Equal(last.Time) {
+		t.Errorf("out of order sample stored at %v, want %v", smp.Time, last.Time)
+	}
+}
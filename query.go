@@ -0,0 +1,464 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A query is an expression over the stored values, a small subset of PromQL:
+//
+//	AvgLatency{app="test-app"}                  instant selector
+//	avg_over_time(AvgLatency{host=~"node-.*"}[5m])  range function
+//	FailAmount / AccessAmount * 100             arithmetic
+//
+// Selectors name a value and match the labels of the samples it comes from:
+// app, domain, host, the static target labels, target, the labels of
+// Prometheus series, and __name__ for the name itself. Range selectors such
+// as x[5m] are only valid as the argument of a range function. Binary
+// operators between two selections pair the series with exactly the same
+// labels; there is no on or ignoring, and a side with several series of the
+// same labels is an error.
+type expr interface {
+	String() string
+}
+
+type numberExpr struct {
+	value float64
+}
+
+func (e *numberExpr) String() string {
+	return strconv.FormatFloat(e.value, 'g', -1, 64)
+}
+
+type selectorExpr struct {
+	name      string
+	matchers  []labelMatcher
+	rng       time.Duration
+	rangeText string
+}
+
+func (e *selectorExpr) String() string {
+	s := e.name
+	if len(e.matchers) > 0 {
+		parts := make([]string, len(e.matchers))
+		for i, m := range e.matchers {
+			parts[i] = m.String()
+		}
+		s += "{" + strings.Join(parts, ",") + "}"
+	}
+	if e.rng > 0 {
+		s += "[" + e.rangeText + "]"
+	}
+	return s
+}
+
+type callExpr struct {
+	fn  string
+	arg *selectorExpr
+}
+
+func (e *callExpr) String() string {
+	return e.fn + "(" + e.arg.String() + ")"
+}
+
+type binaryExpr struct {
+	op       byte
+	lhs, rhs expr
+}
+
+func (e *binaryExpr) String() string {
+	return operand(e.lhs, e.op, false) + " " + string(e.op) + " " + operand(e.rhs, e.op, true)
+}
+
+// operand formats a side of a binary expression, in parentheses where the
+// precedence of op requires them.
+func operand(e expr, op byte, right bool) string {
+	if b, ok := e.(*binaryExpr); ok {
+		if precedence(b.op) < precedence(op) || (right && precedence(b.op) == precedence(op)) {
+			return "(" + b.String() + ")"
+		}
+	}
+	return e.String()
+}
+
+func precedence(op byte) int {
+	if op == '*' || op == '/' {
+		return 2
+	}
+	return 1
+}
+
+type negExpr struct {
+	arg expr
+}
+
+func (e *negExpr) String() string {
+	if _, ok := e.arg.(*binaryExpr); ok {
+		return "-(" + e.arg.String() + ")"
+	}
+	return "-" + e.arg.String()
+}
+
+// rangeFuncs reduce the points of a range selector at every step. They
+// return false when the points are too few.
+var rangeFuncs = map[string]func(points []point) (float64, bool){
+	"avg_over_time": func(points []point) (float64, bool) {
+		var sum float64
+		for _, p := range points {
+			sum += p.V
+		}
+		return sum / float64(len(points)), len(points) > 0
+	},
+	"min_over_time": func(points []point) (float64, bool) {
+		if len(points) == 0 {
+			return 0, false
+		}
+		min := points[0].V
+		for _, p := range points[1:] {
+			if p.V < min {
+				min = p.V
+			}
+		}
+		return min, true
+	},
+	"max_over_time": func(points []point) (float64, bool) {
+		if len(points) == 0 {
+			return 0, false
+		}
+		max := points[0].V
+		for _, p := range points[1:] {
+			if p.V > max {
+				max = p.V
+			}
+		}
+		return max, true
+	},
+	// rate is the per second increase of a counter between the first and
+	// last points of the range, across resets.
+	"rate": func(points []point) (float64, bool) {
+		if len(points) < 2 {
+			return 0, false
+		}
+		var increase float64
+		for i := 1; i < len(points); i++ {
+			increase += counterIncrease(points[i-1].V, points[i].V)
+		}
+		return increase / points[len(points)-1].T.Sub(points[0].T).Seconds(), true
+	},
+	// delta is the change of a gauge between the first and last points of
+	// the range.
+	"delta": func(points []point) (float64, bool) {
+		if len(points) < 2 {
+			return 0, false
+		}
+		return points[len(points)-1].V - points[0].V, true
+	},
+}
+
+// queryError is returned for a query that cannot be parsed.
+type queryError struct {
+	pos int
+	msg string
+}
+
+func (e queryError) Error() string {
+	return fmt.Sprintf("query: %s at position %d", e.msg, e.pos+1)
+}
+
+// parseQuery parses a query.
+func parseQuery(s string) (expr, error) {
+	p := &parser{s: s}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.pos:])
+	}
+	return e, nil
+}
+
+// parser is a recursive descent parser reading the query straight from the
+// string.
+type parser struct {
+	s   string
+	pos int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return queryError{p.pos, fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\r\n", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// next skips spaces and returns the next byte, or 0 at the end.
+func (p *parser) next() byte {
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *parser) expect(c byte) error {
+	if p.next() != c {
+		if p.pos >= len(p.s) {
+			return p.errorf("expected %q, got end of query", c)
+		}
+		return p.errorf("expected %q, got %q", c, p.s[p.pos])
+	}
+	p.pos++
+	return nil
+}
+
+// expr := term (('+' | '-') term)*
+func (p *parser) expr() (expr, error) {
+	lhs, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for c := p.next(); c == '+' || c == '-'; c = p.next() {
+		p.pos++
+		rhs, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &binaryExpr{c, lhs, rhs}
+	}
+	return lhs, nil
+}
+
+// term := unary (('*' | '/') unary)*
+func (p *parser) term() (expr, error) {
+	lhs, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for c := p.next(); c == '*' || c == '/'; c = p.next() {
+		p.pos++
+		rhs, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &binaryExpr{c, lhs, rhs}
+	}
+	return lhs, nil
+}
+
+// unary := ('-' | '+') unary | primary
+func (p *parser) unary() (expr, error) {
+	switch p.next() {
+	case '-':
+		p.pos++
+		arg, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &negExpr{arg}, nil
+	case '+':
+		p.pos++
+		return p.unary()
+	}
+	return p.primary()
+}
+
+// primary := number | '(' expr ')' | function '(' selector ')' | selector
+func (p *parser) primary() (expr, error) {
+	c := p.next()
+	switch {
+	case c == 0:
+		return nil, p.errorf("unexpected end of query")
+	case c == '{':
+		// A selector without a name, such as {app="test-app"}, selects the
+		// values of every name.
+		start := p.pos
+		sel, err := p.selector("")
+		if err != nil {
+			return nil, err
+		}
+		if len(sel.matchers) == 0 {
+			p.pos = start
+			return nil, p.errorf("selector without a name needs a label matcher")
+		}
+		if sel.rng > 0 {
+			p.pos = start
+			return nil, p.errorf("range selector %s must be the argument of a range function", sel)
+		}
+		return sel, nil
+	case c == '(':
+		p.pos++
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(')')
+	case c == '.' || isDigit(c):
+		return p.number()
+	case isIdentStart(c):
+		start := p.pos
+		name := p.ident()
+		if p.next() == '(' {
+			if _, ok := rangeFuncs[name]; !ok {
+				p.pos = start
+				return nil, p.errorf("unknown function %s", name)
+			}
+			p.pos++
+			p.skipSpace()
+			argStart := p.pos
+			if !isIdentStart(p.next()) {
+				return nil, p.errorf("%s needs a range selector such as AvgLatency[5m]", name)
+			}
+			arg, err := p.selector(p.ident())
+			if err != nil {
+				return nil, err
+			}
+			if arg.rng == 0 {
+				p.pos = argStart
+				return nil, p.errorf("%s needs a range selector such as %s[5m]", name, arg.name)
+			}
+			return &callExpr{name, arg}, p.expect(')')
+		}
+		sel, err := p.selector(name)
+		if err != nil {
+			return nil, err
+		}
+		if sel.rng > 0 {
+			p.pos = start
+			return nil, p.errorf("range selector %s must be the argument of a range function", sel)
+		}
+		return sel, nil
+	}
+	return nil, p.errorf("unexpected %q", c)
+}
+
+func (p *parser) number() (expr, error) {
+	start := p.pos
+	for p.pos < len(p.s) && (isDigit(p.s[p.pos]) || p.s[p.pos] == '.') {
+		p.pos++
+	}
+	if p.pos < len(p.s) && (p.s[p.pos] == 'e' || p.s[p.pos] == 'E') {
+		p.pos++
+		if p.pos < len(p.s) && (p.s[p.pos] == '+' || p.s[p.pos] == '-') {
+			p.pos++
+		}
+		for p.pos < len(p.s) && isDigit(p.s[p.pos]) {
+			p.pos++
+		}
+	}
+	v, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+	if err != nil {
+		p.pos = start
+		return nil, p.errorf("invalid number")
+	}
+	return &numberExpr{v}, nil
+}
+
+func (p *parser) ident() string {
+	start := p.pos
+	for p.pos < len(p.s) && (isIdentStart(p.s[p.pos]) || isDigit(p.s[p.pos])) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// selector := name ('{' matcher (',' matcher)* '}')? ('[' duration ']')?
+func (p *parser) selector(name string) (*selectorExpr, error) {
+	sel := &selectorExpr{name: name}
+	if p.next() == '{' {
+		p.pos++
+		for p.next() != '}' {
+			m, err := p.matcher()
+			if err != nil {
+				return nil, err
+			}
+			sel.matchers = append(sel.matchers, m)
+			if p.next() != ',' {
+				break
+			}
+			p.pos++
+		}
+		if err := p.expect('}'); err != nil {
+			return nil, err
+		}
+	}
+	if p.next() == '[' {
+		p.pos++
+		end := strings.IndexByte(p.s[p.pos:], ']')
+		if end < 0 {
+			return nil, p.errorf("unterminated range")
+		}
+		sel.rangeText = strings.TrimSpace(p.s[p.pos : p.pos+end])
+		d, err := parseDuration(sel.rangeText)
+		if err != nil {
+			return nil, p.errorf("invalid range %q", sel.rangeText)
+		}
+		sel.rng = d
+		p.pos += end + 1
+	}
+	return sel, nil
+}
+
+// matcher := label ('=' | '!=' | '=~' | '!~') string
+func (p *parser) matcher() (labelMatcher, error) {
+	if !isIdentStart(p.next()) {
+		return labelMatcher{}, p.errorf("expected a label name")
+	}
+	name := p.ident()
+	p.skipSpace()
+	var op string
+	for _, o := range []string{"=~", "!~", "!=", "="} {
+		if strings.HasPrefix(p.s[p.pos:], o) {
+			op = o
+			break
+		}
+	}
+	if len(op) == 0 {
+		return labelMatcher{}, p.errorf("expected =, !=, =~ or !~ after %s", name)
+	}
+	p.pos += len(op)
+	p.skipSpace()
+	quoted, err := strconv.QuotedPrefix(p.s[p.pos:])
+	if err != nil {
+		return labelMatcher{}, p.errorf("expected a quoted label value")
+	}
+	value, _ := strconv.Unquote(quoted)
+	m, err := newLabelMatcher(name, op, value)
+	if err != nil {
+		return labelMatcher{}, p.errorf("invalid regexp %q: %v", value, err)
+	}
+	p.pos += len(quoted)
+	return m, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// seriesName formats a series for legends, e.g. AvgLatency{app="test-app"}.
+func seriesName(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + strconv.Quote(labels[k])
+	}
+	if len(pairs) == 0 && len(name) > 0 {
+		return name
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	for query, want := range map[string]string{
+		"AvgLatency": "AvgLatency",
+		`AvgLatency{app="test-app", host=~"node-.*"}`:                   `AvgLatency{app="test-app",host=~"node-.*"}`,
+		"avg_over_time(AvgLatency{app='test-app'}[5m])":                 "", // not a quoted string
+		`avg_over_time( AvgLatency{app="x"} [5m] )`:                     `avg_over_time(AvgLatency{app="x"}[5m])`,
+		"FailAmount / AccessAmount * 100":                               "FailAmount / AccessAmount * 100",
+		"FailAmount / (AccessAmount * 100)":                             "FailAmount / (AccessAmount * 100)",
+		"(1 + 2) * -rate(AccessAmount[1h])":                             "(1 + 2) * -rate(AccessAmount[1h])",
+		"a - (b - c)":                                                   "a - (b - c)",
+		"a - b - c":                                                     "a - b - c",
+		`http_requests_total{code!="500"} / 1e3`:                        `http_requests_total{code!="500"} / 1000`,
+		"delta(MaxConcurrent[1d])":                                      "delta(MaxConcurrent[1d])",
+		"max_over_time(AvgLatency[5m]) - min_over_time(AvgLatency[5m])": "max_over_time(AvgLatency[5m]) - min_over_time(AvgLatency[5m])",
+	} {
+		e, err := parseQuery(query)
+		if want == "" {
+			if err == nil {
+				t.Errorf("parseQuery(%q) = %s, want an error", query, e)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseQuery(%q): %v", query, err)
+			continue
+		}
+		if got := e.String(); got != want {
+			t.Errorf("parseQuery(%q) = %s, want %s", query, got, want)
+		}
+	}
+
+	for _, query := range []string{
+		"",
+		"AvgLatency[5m]",
+		"rate(AccessAmount)",
+		"sum(AccessAmount)",
+		"rate(1)",
+		`AvgLatency{app="x"`,
+		`AvgLatency{app=x}`,
+		`AvgLatency{app=~"("}`,
+		"AvgLatency[5x]",
+		"(1 + 2",
+		"1 +",
+		"AvgLatency AccessAmount",
+	} {
+		if e, err := parseQuery(query); err == nil {
+			t.Errorf("parseQuery(%q) = %s, want an error", query, e)
+		}
+	}
+}
+
+func TestEvalQuery(t *testing.T) {
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	cfg := &config{
+		Targets:        []target{{Name: "orders"}, {Name: "search"}},
+		ScrapeInterval: time.Minute,
+	}
+	s, _ := newStore(100, "")
+	for i := 0; i <= 10; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		s.add("orders", sample{
+			Time:   at,
+			Labels: map[string]string{"app": "orders", "domain": "shop"},
+			Values: map[string]float64{"AccessAmount": float64(i) * 600, "FailAmount": float64(i) * 60, "AvgLatency": float64(10 + i)},
+		})
+		s.add("search", sample{
+			Time:   at,
+			Labels: map[string]string{"app": "search", "domain": "web"},
+			Values: map[string]float64{"AccessAmount": float64(i) * 60, "FailAmount": 0, "AvgLatency": 5},
+		})
+	}
+	q := newQueryEngine(cfg, s)
+	now := []time.Time{start.Add(10 * time.Minute)}
+
+	instant := func(query string) map[string]float64 {
+		t.Helper()
+		result, err := q.run(query, now)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		values := map[string]float64{}
+		for _, s := range result {
+			values[s.Labels["app"]] = s.Points[len(s.Points)-1].Value
+		}
+		return values
+	}
+	for _, c := range []struct {
+		query string
+		want  map[string]float64
+	}{
+		{`AvgLatency{app="orders"}`, map[string]float64{"orders": 20}},
+		{`AvgLatency{domain=~"shop|web"}`, map[string]float64{"orders": 20, "search": 5}},
+		{"FailAmount / AccessAmount", map[string]float64{"orders": 0.1, "search": 0}},
+		{`avg_over_time(AvgLatency{app="orders"}[5m])`, map[string]float64{"orders": 18}},
+		{`max_over_time(AvgLatency{app="orders"}[5m]) - min_over_time(AvgLatency{app="orders"}[5m])`, map[string]float64{"orders": 4}},
+		{`rate(AccessAmount{target="orders"}[5m])`, map[string]float64{"orders": 10}},
+		{`delta(AvgLatency{app="orders"}[5m]) * 2`, map[string]float64{"orders": 8}},
+		{"-AvgLatency{app=\"search\"} + 1", map[string]float64{"search": -4}},
+		{"2 * 3", map[string]float64{"": 6}},
+	} {
+		got := instant(c.query)
+		if len(got) != len(c.want) {
+			t.Errorf("%s = %v, want %v", c.query, got, c.want)
+			continue
+		}
+		for app, want := range c.want {
+			if v, ok := got[app]; !ok || math.Abs(v-want) > 1e-9 {
+				t.Errorf("%s = %v, want %v", c.query, got, c.want)
+			}
+		}
+	}
+
+	// Over a range, steps before the first sample or beyond the lookback
+	// have no value.
+	steps, _ := querySteps(start.Add(10*time.Minute), 15*time.Minute, 5*time.Minute)
+	result, err := q.run(`AvgLatency{app="orders"}`, steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 || len(result[0].Points) != 3 {
+		t.Fatalf("got %v, want one series of 3 points", result)
+	}
+	// Without a name the selector holds every value of orders under the
+	// same labels, which cannot be paired.
+	if _, err := q.run(`{app="orders"} / AccessAmount`, now); err == nil || !strings.Contains(err.Error(), "one to one") {
+		t.Errorf("ambiguous operands = %v, want an error", err)
+	}
+	if _, err := querySteps(start, 24*time.Hour, time.Second); err == nil {
+		t.Error("querySteps should refuse more than maxQuerySteps points")
+	}
+}
+
+func TestQueryChartGaps(t *testing.T) {
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	cfg := &config{Targets: []target{{Name: "orders"}}, ScrapeInterval: time.Minute}
+	s, _ := newStore(100, "")
+	for i := 0; i <= 12; i++ {
+		smp := sample{Time: start.Add(time.Duration(i) * time.Minute), Labels: map[string]string{"app": "orders"}}
+		// orders is down from minute 4 to 8.
+		if i < 4 || i > 8 {
+			smp.Values = map[string]float64{"AvgLatency": float64(10 + i)}
+		}
+		s.add("orders", smp)
+	}
+	steps, _ := querySteps(start.Add(12*time.Minute), 12*time.Minute, time.Minute)
+	result, err := newQueryEngine(cfg, s).run("AvgLatency", steps)
+	if err != nil || len(result) != 1 {
+		t.Fatalf("run = %v, %v", result, err)
+	}
+	// The lookback of two scrape intervals keeps the value of minute 3 until
+	// minute 5.
+	ts := querySeriesLine(result[0], steps)
+	if len(ts.XValues) != 10 || len(ts.breaks) != 1 || ts.breaks[0] != 6 {
+		t.Errorf("line of %d points breaks at %v, want 10 points breaking at [6]", len(ts.XValues), ts.breaks)
+	}
+	if err := renderQueryChart(ioutil.Discard, "AvgLatency", result, steps, chartOptions{Format: "png", Width: 512, Height: 256}); err != nil {
+		t.Errorf("rendering the query chart: %v", err)
+	}
+}
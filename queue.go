@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// queueConfig configures the queue of an exporter sending over HTTP.
+type queueConfig struct {
+	// BatchSize is the most samples sent in one request.
+	BatchSize int
+	// Capacity bounds the queue. When it is full the oldest samples are
+	// dropped, so a slow or down backend never stalls the scrapes.
+	Capacity      int
+	FlushInterval time.Duration
+	Timeout       time.Duration
+	// WALPath is the file the queue is kept in across restarts, in memory
+	// only when empty.
+	WALPath string
+}
+
+// defaultQueueConfig is the queue of the sinks of the config file, and the
+// defaults of the REMOTE_WRITE_ and OTLP_ variables.
+var defaultQueueConfig = queueConfig{
+	BatchSize:     500,
+	Capacity:      10000,
+	FlushInterval: 5 * time.Second,
+	Timeout:       10 * time.Second,
+}
+
+// queueExporter queues the samples of every scrape and sends them in
+// batches to an HTTP endpoint, one request at a time. Failed requests are
+// retried with exponential backoff while the queue keeps filling up to its
+// capacity; requests the endpoint rejects as invalid are dropped.
+type queueExporter struct {
+	exporterName string
+	url          string
+	cfg          queueConfig
+	// encode returns the body of a request sending a batch and its
+	// headers.
+	encode func(batch []exportSample) ([]byte, http.Header)
+	// targets are the names of the targets exported, every target when
+	// nil.
+	targets map[string]bool
+	client  *http.Client
+	notify  chan struct{}
+
+	minBackoff, maxBackoff time.Duration
+
+	mu    sync.Mutex
+	queue []exportSample
+	// first is the sequence number of queue[0], counting every sample
+	// ever queued, so a batch can be acknowledged after samples were
+	// dropped from the front while it was in flight.
+	first uint64
+	wal   *wal
+}
+
+func newQueueExporter(name, url string, cfg queueConfig, encode func([]exportSample) ([]byte, http.Header)) (*queueExporter, error) {
+	w := &queueExporter{
+		exporterName: name,
+		url:          url,
+		cfg:          cfg,
+		encode:       encode,
+		client:       &http.Client{Timeout: cfg.Timeout},
+		notify:       make(chan struct{}, 1),
+		minBackoff:   500 * time.Millisecond,
+		maxBackoff:   30 * time.Second,
+	}
+	if len(cfg.WALPath) > 0 {
+		var err error
+		if w.wal, w.queue, err = openWAL(cfg.WALPath, cfg.Capacity); err != nil {
+			return nil, fmt.Errorf("opening %s WAL: %v", name, err)
+		}
+	}
+	return w, nil
+}
+
+func (w *queueExporter) name() string {
+	return w.exporterName
+}
+
+func (w *queueExporter) export(t target, smp sample) {
+	if w.targets != nil && !w.targets[t.Name] {
+		return
+	}
+	samples := exportSamples(t, smp)
+	w.mu.Lock()
+	if w.wal != nil {
+		if err := w.wal.append(samples); err != nil {
+			logger.Warn("writing WAL failed", "exporter", w.name(), "error", err)
+		}
+	}
+	w.queue = append(w.queue, samples...)
+	if over := len(w.queue) - w.cfg.Capacity; over > 0 {
+		w.queue = w.queue[:copy(w.queue, w.queue[over:])]
+		w.first += uint64(over)
+		exportedSamples.add(float64(over), w.name(), "dropped")
+		w.compact()
+	}
+	full := len(w.queue) >= w.cfg.BatchSize
+	w.mu.Unlock()
+	if full {
+		select {
+		case w.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *queueExporter) pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.queue)
+}
+
+// compact rewrites the WAL once most of its lines were sent or dropped.
+func (w *queueExporter) compact() {
+	if w.wal == nil || w.wal.lines <= 2*len(w.queue)+w.cfg.BatchSize {
+		return
+	}
+	if err := w.wal.rewrite(w.queue); err != nil {
+		logger.Warn("compacting WAL failed", "exporter", w.name(), "error", err)
+	}
+}
+
+// peek returns the oldest batch of the queue and its sequence number.
+func (w *queueExporter) peek() ([]exportSample, uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := len(w.queue)
+	if n > w.cfg.BatchSize {
+		n = w.cfg.BatchSize
+	}
+	return append([]exportSample(nil), w.queue[:n]...), w.first
+}
+
+// ack removes a batch from the queue, or what is left of it.
+func (w *queueExporter) ack(seq uint64, n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	end := seq + uint64(n)
+	if end <= w.first {
+		return
+	}
+	k := int(end - w.first)
+	if k > len(w.queue) {
+		k = len(w.queue)
+	}
+	w.queue = w.queue[:copy(w.queue, w.queue[k:])]
+	w.first += uint64(k)
+	w.compact()
+}
+
+func (w *queueExporter) run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.notify:
+		}
+		w.flush(ctx)
+	}
+}
+
+// flush sends batches until the queue is empty or ctx is done.
+func (w *queueExporter) flush(ctx context.Context) error {
+	for {
+		batch, seq := w.peek()
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := w.sendWithRetry(ctx, batch); err != nil {
+			return err
+		}
+		w.ack(seq, len(batch))
+	}
+}
+
+func (w *queueExporter) close(deadline context.Context) error {
+	err := w.flush(deadline)
+	if w.wal != nil {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if err := w.wal.rewrite(w.queue); err != nil {
+			return err
+		}
+		return w.wal.close()
+	}
+	if err != nil {
+		return fmt.Errorf("%d samples not sent: %v", w.pending(), err)
+	}
+	return nil
+}
+
+// sendWithRetry sends a batch until it is accepted or rejected, and returns
+// an error only when ctx is done first.
+func (w *queueExporter) sendWithRetry(ctx context.Context, batch []exportSample) error {
+	backoff := w.minBackoff
+	for attempt := 1; ; attempt++ {
+		err := w.send(ctx, batch)
+		if err == nil {
+			exportedSamples.add(float64(len(batch)), w.name(), "sent")
+			return nil
+		}
+		if code, ok := err.(statusError); ok && code < 500 && code != http.StatusTooManyRequests {
+			logger.Error("export rejected, dropping batch", "exporter", w.name(), "error", err, "samples", len(batch))
+			exportedSamples.add(float64(len(batch)), w.name(), "rejected")
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logger.Warn("export failed, retrying", "exporter", w.name(), "error", err, "attempt", attempt, "backoff", backoff.String())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > w.maxBackoff {
+			backoff = w.maxBackoff
+		}
+	}
+}
+
+func (w *queueExporter) send(ctx context.Context, batch []exportSample) error {
+	body, header := w.encode(batch)
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("User-Agent", "k8s-app-monitor-agent")
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		exportRequests.inc(w.name(), "error")
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	exportRequests.inc(w.name(), fmt.Sprint(resp.StatusCode))
+	if resp.StatusCode/100 != 2 {
+		return statusError(resp.StatusCode)
+	}
+	return nil
+}
+
+// wal keeps the queue of an exporter in a file of JSON lines, so
+// they survive restarts. Samples are appended as they are queued, and the
+// file is rewritten with just the queue once sent and dropped samples make
+// up most of it, and on close. After a crash the samples sent since the
+// last rewrite are sent again.
+type wal struct {
+	path  string
+	f     *os.File
+	lines int
+}
+
+// openWAL opens the WAL at path and returns the newest capacity samples it
+// holds.
+func openWAL(path string, capacity int) (*wal, []exportSample, error) {
+	var samples []exportSample
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var s exportSample
+			// A torn last line from a crash is skipped.
+			if err := json.Unmarshal(scanner.Bytes(), &s); err == nil {
+				samples = append(samples, s)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if len(samples) > capacity {
+		samples = samples[len(samples)-capacity:]
+	}
+	w := &wal{path: path}
+	if err := w.rewrite(samples); err != nil {
+		return nil, nil, err
+	}
+	return w, samples, nil
+}
+
+func (w *wal) append(samples []exportSample) error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, s := range samples {
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	if _, err := w.f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	w.lines += len(samples)
+	return nil
+}
+
+// rewrite replaces the file atomically with samples.
+func (w *wal) rewrite(samples []exportSample) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(w.path), ".wal")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	bw := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(bw)
+	for _, s := range samples {
+		if err := enc.Encode(s); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), w.path); err != nil {
+		return err
+	}
+	if w.f != nil {
+		w.f.Close()
+	}
+	if w.f, err = os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	w.lines = len(samples)
+	return nil
+}
+
+func (w *wal) close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/golang/snappy"
+)
+
+// remoteWriteConfig configures the Prometheus remote write exporter.
+type remoteWriteConfig struct {
+	URL string
+	queueConfig
+}
+
+// newRemoteWriter returns an exporter sending every sample to a Prometheus
+// remote write endpoint.
+func newRemoteWriter(cfg remoteWriteConfig) (*queueExporter, error) {
+	return newQueueExporter("remote_write", cfg.URL, cfg.queueConfig, func(batch []exportSample) ([]byte, http.Header) {
+		return snappy.Encode(nil, encodeWriteRequest(batch)), http.Header{
+			"Content-Encoding":                  {"snappy"},
+			"Content-Type":                      {"application/x-protobuf"},
+			"X-Prometheus-Remote-Write-Version": {"0.1.0"},
+		}
+	})
+}
+
+// encodeWriteRequest encodes samples as a prometheus.WriteRequest protocol
+// buffer, the samples of a series together in their order.
+func encodeWriteRequest(samples []exportSample) []byte {
+	type series struct {
+		labels  []exportLabel
+		samples []exportSample
+	}
+	var all []*series
+	index := map[string]*series{}
+	for _, s := range samples {
+		parts := make([]string, len(s.Labels))
+		for i, l := range s.Labels {
+			parts[i] = l.Name + "=" + l.Value
+		}
+		key := strings.Join(parts, "\xff")
+		ts, ok := index[key]
+		if !ok {
+			ts = &series{labels: s.Labels}
+			index[key] = ts
+			all = append(all, ts)
+		}
+		ts.samples = append(ts.samples, s)
+	}
+
+	var req protoBuffer
+	for _, ts := range all {
+		var tb protoBuffer
+		for _, l := range ts.labels {
+			var lb protoBuffer
+			lb.string(1, l.Name)
+			lb.string(2, l.Value)
+			tb.bytes(1, lb)
+		}
+		for _, s := range ts.samples {
+			var sb protoBuffer
+			sb.double(1, s.Value)
+			sb.int64(2, s.Timestamp)
+			tb.bytes(2, sb)
+		}
+		req.bytes(1, tb)
+	}
+	return req
+}
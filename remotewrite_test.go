@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// protoFields returns the fields of a protocol buffer message by number, as
+// their raw bytes or their varint or fixed64 value.
+func protoFields(t *testing.T, data []byte) map[int][][]byte {
+	m := map[int][][]byte{}
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		data = data[n:]
+		var v []byte
+		switch tag & 7 {
+		case protoVarint:
+			_, n = binary.Uvarint(data)
+			v, data = data[:n], data[n:]
+		case protoFixed64:
+			v, data = data[:8], data[8:]
+		case protoBytes:
+			l, n := binary.Uvarint(data)
+			v, data = data[n:n+int(l)], data[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+		m[int(tag>>3)] = append(m[int(tag>>3)], v)
+	}
+	return m
+}
+
+// decodeWriteRequest decodes the protocol buffer remote write request of
+// encodeWriteRequest back into its samples.
+func decodeWriteRequest(t *testing.T, data []byte) []exportSample {
+	var samples []exportSample
+	for _, ts := range protoFields(t, data)[1] {
+		f := protoFields(t, ts)
+		var labels []exportLabel
+		for _, l := range f[1] {
+			lf := protoFields(t, l)
+			labels = append(labels, exportLabel{string(lf[1][0]), string(lf[2][0])})
+		}
+		for _, s := range f[2] {
+			sf := protoFields(t, s)
+			ms, _ := binary.Uvarint(sf[2][0])
+			samples = append(samples, exportSample{
+				Labels:    labels,
+				Timestamp: int64(ms),
+				Value:     math.Float64frombits(binary.LittleEndian.Uint64(sf[1][0])),
+			})
+		}
+	}
+	return samples
+}
+
+// receiver is a remote write endpoint failing the first requests.
+type receiver struct {
+	t        *testing.T
+	failures int
+
+	mu       sync.Mutex
+	requests int
+	samples  []exportSample
+}
+
+func (r *receiver) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	if r.requests <= r.failures {
+		http.Error(res, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(res, "unexpected headers", http.StatusBadRequest)
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.samples = append(r.samples, decodeWriteRequest(r.t, data)...)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func testRemoteWriter(t *testing.T, url, walPath string) *queueExporter {
+	w, err := newRemoteWriter(remoteWriteConfig{
+		URL:           url,
+		BatchSize:     3,
+		Capacity:      8,
+		FlushInterval: time.Hour,
+		Timeout:       time.Second,
+		WALPath:       walPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.minBackoff, w.maxBackoff = time.Millisecond, 4*time.Millisecond
+	return w
+}
+
+func TestRemoteWrite(t *testing.T) {
+	r := &receiver{t: t, failures: 2}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	w := testRemoteWriter(t, server.URL, "")
+
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	tg := target{Name: "orders"}
+	for i := 0; i < 3; i++ {
+		w.export(tg, sample{
+			Time:   start.Add(time.Duration(i) * time.Second),
+			Labels: map[string]string{"app": "orders", "domain": "shop", "host": "node-1"},
+			Values: map[string]float64{"AccessAmount": float64(i), `http_requests_total{code="200"}`: 7, "FailRatio": math.NaN()},
+		})
+	}
+	if err := w.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if w.pending() != 0 || r.requests != 4 {
+		t.Errorf("%d samples pending after %d requests, want 0 after 4", w.pending(), r.requests)
+	}
+	if len(r.samples) != 6 {
+		t.Fatalf("received %d samples, want 6", len(r.samples))
+	}
+	want := exportSample{
+		Labels: []exportLabel{
+			{"__name__", "AccessAmount"}, {"app", "orders"}, {"domain", "shop"}, {"host", "node-1"}, {"target", "orders"},
+		},
+		Timestamp: start.Unix() * 1000,
+		Value:     0,
+	}
+	if !reflect.DeepEqual(r.samples[0], want) {
+		t.Errorf("first sample = %+v, want %+v", r.samples[0], want)
+	}
+	series := 0
+	for _, s := range r.samples {
+		if l := s.Labels; l[0].Value == "http_requests_total" {
+			series++
+			if l[1] != (exportLabel{"app", "orders"}) || l[2] != (exportLabel{"code", "200"}) {
+				t.Errorf("series labels = %v", l)
+			}
+		}
+	}
+	if series != 3 {
+		t.Errorf("received %d http_requests_total samples, want 3", series)
+	}
+
+	// A full queue drops its oldest samples.
+	for i := 0; i < 6; i++ {
+		w.export(tg, sample{Time: start.Add(time.Duration(i) * time.Second), Values: map[string]float64{"AccessAmount": float64(i)}})
+	}
+	if w.pending() != 6 {
+		t.Fatalf("%d samples pending, want 6", w.pending())
+	}
+	for i := 6; i < 10; i++ {
+		w.export(tg, sample{Time: start.Add(time.Duration(i) * time.Second), Values: map[string]float64{"AccessAmount": float64(i)}})
+	}
+	batch, _ := w.peek()
+	if w.pending() != 8 || batch[0].Value != 2 {
+		t.Errorf("%d samples pending starting with %v, want 8 starting with 2", w.pending(), batch[0].Value)
+	}
+}
+
+func TestRemoteWriteWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "remote-write.wal")
+	down := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		http.Error(res, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	w := testRemoteWriter(t, down.URL, path)
+	for i := 0; i < 10; i++ {
+		w.export(target{Name: "orders"}, sample{Time: time.Unix(int64(i), 0), Values: map[string]float64{"AccessAmount": float64(i)}})
+	}
+	deadline, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := w.close(deadline); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &receiver{t: t}
+	up := httptest.NewServer(r)
+	defer up.Close()
+	w = testRemoteWriter(t, up.URL, path)
+	if w.pending() != 8 {
+		t.Fatalf("%d samples restored, want 8", w.pending())
+	}
+	if err := w.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.samples) != 8 || r.samples[0].Value != 2 || r.samples[7].Value != 9 {
+		t.Errorf("received %v, want values 2 to 9", r.samples)
+	}
+	if data, _ := ioutil.ReadFile(path); len(data) != 0 {
+		t.Errorf("WAL holds %q after everything was sent", data)
+	}
+}
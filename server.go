@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	// ready is set once the config has loaded and the first scrape round
+	// has finished, and cleared again when the agent starts shutting down.
+	ready int32
+	// shuttingDown keeps a late first scrape round from marking the agent
+	// ready again during shutdown.
+	shuttingDown int32
+)
+
+// healthz reports that the process is alive and serving requests.
+func healthz(res http.ResponseWriter, req *http.Request) {
+	fmt.Fprintln(res, "ok")
+}
+
+// readyz reports whether the agent should receive traffic.
+func readyz(res http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&ready) == 0 {
+		http.Error(res, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(res, "ok")
+}
+
+// stopServing marks the agent unready and keeps serving until delay fires,
+// so endpoints and load balancers see /readyz fail and stop sending
+// requests, then shuts the servers down. Shutdown waits for in-flight chart
+// renders to complete until deadline.
+func stopServing(servers []*http.Server, delay <-chan time.Time, deadline context.Context) {
+	atomic.StoreInt32(&shuttingDown, 1)
+	atomic.StoreInt32(&ready, 0)
+	select {
+	case <-delay:
+	case <-deadline.Done():
+	}
+	for _, srv := range servers {
+		if err := srv.Shutdown(deadline); err != nil {
+			logger.Error("draining requests failed", "addr", srv.Addr, "error", err)
+		}
+	}
+}
+
+// serve runs the collectors and the HTTP server until SIGTERM or SIGINT, then
+// keeps serving unready for cfg.ShutdownDelay, drains in-flight requests,
+// stops the collectors and flushes the store within cfg.ShutdownTimeout.
+func serve(cfg *config) error {
+	s, err := newStore(cfg.StorageCapacity, cfg.StoragePath)
+	if err != nil {
+		return err
+	}
+	// The TLS files are watched until the server has shut down.
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	tlsConfig, err := tlsConfig(watchCtx)
+	if err != nil {
+		return err
+	}
+
+	exporters, err := newExporters(cfg)
+	if err != nil {
+		return err
+	}
+	e := startExporters(exporters)
+
+	ctx, stopCollectors := context.WithCancel(context.Background())
+	c := newCollector(cfg, s, exporters)
+	c.start(ctx)
+	go func() {
+		<-c.firstRound
+		if atomic.LoadInt32(&shuttingDown) == 0 {
+			atomic.StoreInt32(&ready, 1)
+		}
+	}()
+
+	q := newQueryEngine(cfg, s)
+	charts := newRenderCache(cfg.RenderCacheSize)
+	http.HandleFunc(path, instrument("chart", drawChart(cfg, s, charts)))
+	http.HandleFunc("/healthz", instrument("healthz", healthz))
+	http.HandleFunc("/readyz", instrument("readyz", readyz))
+	http.HandleFunc(agentMetricsPath, instrument("metrics", agentMetrics(s, c, exporters)))
+	http.HandleFunc("/api/metrics", instrument("api_metrics", apiMetrics(cfg, s)))
+	http.HandleFunc("/api/samples", instrument("api_samples", apiSamples(cfg, s)))
+	http.HandleFunc("/api/push", instrument("api_push", apiPush(cfg, c)))
+	http.HandleFunc("/api/query", instrument("api_query", apiQuery(q)))
+	http.HandleFunc("/api/v1/query", instrument("api_v1_query", apiPromQuery(q)))
+	http.HandleFunc("/api/v1/query_range", instrument("api_v1_query_range", apiPromQueryRange(q)))
+	http.HandleFunc("/api/v1/labels", instrument("api_v1_labels", apiPromLabels(q)))
+	http.HandleFunc("/api/v1/label/", instrument("api_v1_label_values", apiPromLabelValues(q)))
+	http.HandleFunc("/api/v1/series", instrument("api_v1_series", apiPromSeries(q)))
+	http.HandleFunc("/api/aggregate", instrument("api_aggregate", apiAggregate(cfg, s)))
+	http.HandleFunc("/api/percentiles", instrument("api_percentiles", apiPercentiles(cfg, s)))
+	http.HandleFunc("/api/slo", instrument("api_slo", apiSLO(cfg, s)))
+	http.HandleFunc("/targets", instrument("targets", targetsStatusPage(c)))
+	http.HandleFunc("/api/targets", instrument("api_targets", apiTargets(c)))
+	http.HandleFunc("/slo", instrument("slo", sloStatusPage(cfg, s)))
+	http.HandleFunc("/slo/chart", instrument("slo_chart", sloChart(cfg, s, charts)))
+
+	listenPort := fmt.Sprintf(":%s", listenPort())
+	server := &http.Server{
+		Addr:      listenPort,
+		Handler:   withRequestID(accessLog(http.DefaultServeMux)),
+		TLSConfig: tlsConfig,
+		ErrorLog:  slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	servers := []*http.Server{server}
+	if port := os.Getenv("HEALTH_PORT"); len(port) > 0 {
+		// kubelet probes carry no client certificate, so the probe endpoints
+		// get a listener of their own that does not ask for one.
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", instrument("healthz", healthz))
+		mux.HandleFunc("/readyz", instrument("readyz", readyz))
+		servers = append(servers, &http.Server{
+			Addr:      ":" + port,
+			Handler:   mux,
+			TLSConfig: probeTLSConfig(tlsConfig),
+			ErrorLog:  server.ErrorLog,
+		})
+	}
+	errc := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			logger.Info("listening", "addr", srv.Addr, "tls", srv.TLSConfig != nil)
+			if srv.TLSConfig == nil {
+				errc <- srv.ListenAndServe()
+				return
+			}
+			errc <- srv.ListenAndServeTLS("", "")
+		}(srv)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errc:
+		stopCollectors()
+		return err
+	case <-sig:
+	}
+
+	logger.Info("shutting down", "delay", cfg.ShutdownDelay.String(), "timeout", cfg.ShutdownTimeout.String())
+	deadline, cancel := context.WithTimeout(context.Background(), cfg.ShutdownDelay+cfg.ShutdownTimeout)
+	defer cancel()
+	stopServing(servers, time.After(cfg.ShutdownDelay), deadline)
+	stopCollectors()
+	stopped := make(chan struct{})
+	go func() {
+		c.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-deadline.Done():
+		logger.Error("collectors did not stop before the shutdown deadline")
+	}
+	// Exporters send what the last scrapes queued.
+	e.stop(deadline)
+	return s.flush()
+}
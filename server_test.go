@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resetReadiness restores the readiness of the agent when the test ends.
+func resetReadiness(t *testing.T) {
+	saved, savedShuttingDown := atomic.LoadInt32(&ready), atomic.LoadInt32(&shuttingDown)
+	t.Cleanup(func() {
+		atomic.StoreInt32(&ready, saved)
+		atomic.StoreInt32(&shuttingDown, savedShuttingDown)
+	})
+}
+
+func TestProbes(t *testing.T) {
+	resetReadiness(t)
+	probe := func(h http.HandlerFunc) int {
+		res := httptest.NewRecorder()
+		h(res, httptest.NewRequest("GET", "/", nil))
+		return res.Code
+	}
+	atomic.StoreInt32(&ready, 0)
+	if code := probe(healthz); code != http.StatusOK {
+		t.Errorf("healthz before the first scrape round = %d, want 200", code)
+	}
+	if code := probe(readyz); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz before the first scrape round = %d, want 503", code)
+	}
+	atomic.StoreInt32(&ready, 1)
+	if code := probe(readyz); code != http.StatusOK {
+		t.Errorf("readyz after the first scrape round = %d, want 200", code)
+	}
+}
+
+func TestShutdownOrder(t *testing.T) {
+	resetReadiness(t)
+	atomic.StoreInt32(&ready, 1)
+	atomic.StoreInt32(&shuttingDown, 0)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	get := func(path string) (int, error) {
+		// A fresh connection each time, so a kept-alive one cannot hide
+		// the closed listener.
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		res, err := client.Get("http://" + ln.Addr().String() + path)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	delay := make(chan time.Time)
+	stopped := make(chan struct{})
+	deadline, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go func() {
+		stopServing([]*http.Server{srv}, delay, deadline)
+		close(stopped)
+	}()
+	for atomic.LoadInt32(&ready) == 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// During the delay the agent keeps serving, unready.
+	if code, err := get("/readyz"); err != nil || code != http.StatusServiceUnavailable {
+		t.Errorf("readyz during the shutdown delay = %d, %v, want 503", code, err)
+	}
+	if code, err := get("/healthz"); err != nil || code != http.StatusOK {
+		t.Errorf("healthz during the shutdown delay = %d, %v, want 200", code, err)
+	}
+	select {
+	case <-stopped:
+		t.Fatal("servers shut down before the delay")
+	default:
+	}
+
+	close(delay)
+	<-stopped
+	if _, err := get("/healthz"); err == nil {
+		t.Error("agent still serving after the shutdown")
+	}
+	if atomic.LoadInt32(&shuttingDown) != 1 {
+		t.Error("shutting down is not set, a late first scrape round could mark the agent ready")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	metric "github.com/rootsongjc/k8s-app-monitor-test/service"
+)
+
+// scenarios are the behaviours the simulator can play. random is the
+// vendored test service with its uniformly random values.
+var scenarios = map[string]string{
+	"random":         "uniformly random values from the k8s-app-monitor-test service",
+	"steady":         "steady load following a slow wave",
+	"latency-spikes": "steady load with a 10s latency spike every minute",
+	"error-bursts":   "steady load with a 15s burst of failures every 90s",
+	"slow":           "steady load answering after 2 to 6 seconds",
+	"outage":         "steady load, down for 30s every 90s and restarting afterwards",
+}
+
+// simulator plays a scenario as a fake target. AccessAmount and FailAmount
+// are counters since the simulated app started, FailRatio is the ratio over
+// the last scrape.
+type simulator struct {
+	scenario string
+	start    time.Time
+
+	mu     sync.Mutex
+	rnd    *rand.Rand
+	last   time.Time
+	access float64
+	fail   float64
+	down   bool
+}
+
+// startSimulator serves the scenario on SIMULATE_PORT, or a random port, and
+// points SERVICE_NAME and APP_PORT at it.
+func startSimulator(scenario string) error {
+	if _, ok := scenarios[scenario]; !ok {
+		return fmt.Errorf("unknown SIMULATE scenario %q", scenario)
+	}
+	var h http.Handler = randomServer()
+	if scenario != "random" {
+		now := time.Now()
+		h = &simulator{scenario: scenario, start: now, last: now, rnd: rand.New(rand.NewSource(now.UnixNano()))}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:"+os.Getenv("SIMULATE_PORT"))
+	if err != nil {
+		return err
+	}
+	go http.Serve(l, h)
+
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	os.Setenv("SERVICE_NAME", "127.0.0.1")
+	os.Setenv("APP_PORT", port)
+	logger.Info("simulating target", "scenario", scenario, "addr", l.Addr().String())
+	return nil
+}
+
+// randomServer returns the vendored test service with its request log sent
+// to the agent's logger at debug level instead of stdout. The service vendors
+// its own negroni, so its logger is found by the log.Logger method it embeds.
+func randomServer() http.Handler {
+	n := metric.NewServer()
+	for _, h := range n.Handlers() {
+		if l, ok := h.(interface{ SetOutput(io.Writer) }); ok {
+			l.SetOutput(slog.NewLogLogger(logger.Handler(), slog.LevelDebug).Writer())
+		}
+	}
+	return n
+}
+
+func (s *simulator) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/metrics" {
+		http.NotFound(res, req)
+		return
+	}
+	m, delay, up := s.next(time.Now())
+	time.Sleep(delay)
+	if !up {
+		http.Error(res, "simulated outage", http.StatusServiceUnavailable)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(m)
+}
+
+// next advances the simulated app to now and returns what it reports, how
+// long the response is delayed and whether the app is up.
+func (s *simulator) next(now time.Time) (metric.Metric, time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elapsed := now.Sub(s.start).Seconds()
+	dt := math.Min(now.Sub(s.last).Seconds(), 60)
+	s.last = now
+
+	rps := 100 + 40*math.Sin(2*math.Pi*elapsed/600) + s.rnd.NormFloat64()*5
+	failRatio := math.Max(0, 0.005+s.rnd.NormFloat64()*0.002)
+	avgLatency := 40 + s.rnd.NormFloat64()*4
+	minLatency := 5 + s.rnd.Float64()*3
+	var delay time.Duration
+
+	switch s.scenario {
+	case "latency-spikes":
+		if math.Mod(elapsed, 60) < 10 {
+			avgLatency *= 8
+		}
+	case "error-bursts":
+		if math.Mod(elapsed, 90) < 15 {
+			failRatio = 0.2 + s.rnd.Float64()*0.2
+		}
+	case "slow":
+		delay = time.Duration(2000+s.rnd.Intn(4000)) * time.Millisecond
+		avgLatency += float64(delay / time.Millisecond)
+	case "outage":
+		if math.Mod(elapsed, 90) >= 60 {
+			s.down = true
+			return metric.Metric{}, 0, false
+		}
+		if s.down {
+			// The app restarted, so its counters start over.
+			s.down = false
+			s.access, s.fail = 0, 0
+			dt = 0
+		}
+	}
+
+	requests := rps * dt
+	failures := requests * failRatio
+	s.access += requests
+	s.fail += failures
+	if requests > 0 {
+		failRatio = failures / requests
+	}
+
+	m := metric.Metric{
+		Host:    "simulator",
+		AppName: "sim-app",
+		Domain:  "sim-domain",
+	}
+	m.FailRatio = failRatio
+	m.AccessAmount = int64(s.access)
+	m.FailAmount = int64(s.fail)
+	m.MaxConcurrent = int64(rps * avgLatency / 1000 * (2 + s.rnd.Float64()))
+	m.MinLatency = int64(minLatency)
+	m.AvgLatency = int64(avgLatency)
+	return m, delay, true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSimulator(scenario string, start time.Time) *simulator {
+	return &simulator{scenario: scenario, start: start, last: start, rnd: rand.New(rand.NewSource(1))}
+}
+
+func TestSimulatorScenarios(t *testing.T) {
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(s *simulator, seconds int) (float64, float64, bool) {
+		m, _, up := s.next(start.Add(time.Duration(seconds) * time.Second))
+		return float64(m.AvgLatency), m.FailRatio, up
+	}
+
+	s := newTestSimulator("latency-spikes", start)
+	if spike, _, _ := at(s, 5); spike < 200 {
+		t.Errorf("latency during a spike = %v, want about 320", spike)
+	}
+	if calm, _, _ := at(s, 30); calm > 100 {
+		t.Errorf("latency between spikes = %v, want about 40", calm)
+	}
+
+	s = newTestSimulator("error-bursts", start)
+	at(s, 0)
+	if _, ratio, _ := at(s, 10); ratio < 0.1 {
+		t.Errorf("fail ratio during a burst = %v, want 0.2 to 0.4", ratio)
+	}
+	if _, ratio, _ := at(s, 50); ratio > 0.05 {
+		t.Errorf("fail ratio between bursts = %v, want about 0.005", ratio)
+	}
+
+	s = newTestSimulator("outage", start)
+	for _, sec := range []int{10, 20, 30} {
+		at(s, sec)
+	}
+	if _, _, up := at(s, 70); up {
+		t.Error("outage scenario is up 70s in, want down")
+	}
+	m, _, up := s.next(start.Add(100 * time.Second))
+	if !up || m.AccessAmount != 0 {
+		t.Errorf("after the outage up = %v with %d requests, want a restarted app", up, m.AccessAmount)
+	}
+}
+
+func TestSimulatorScrapes(t *testing.T) {
+	server := httptest.NewServer(newTestSimulator("steady", time.Now()))
+	defer server.Close()
+	tg := target{Name: "sim", URL: server.URL + "/metrics", decoder: legacyDecoder{}}
+	cfg := &config{Targets: []target{tg}, ScrapeInterval: time.Minute}
+	s, _ := newStore(100, "")
+	c := newCollector(cfg, s, nil)
+	for i := 0; i < 3; i++ {
+		c.scrape(context.Background(), tg, logger, &failureLimiter{interval: time.Minute})
+	}
+
+	samples := s.samples("sim")
+	if len(samples) != 3 {
+		t.Fatalf("stored %d samples, want 3", len(samples))
+	}
+	for i, smp := range samples {
+		if smp.Labels["app"] != "sim-app" || smp.Labels["host"] != "simulator" || smp.Labels["domain"] != "sim-domain" {
+			t.Errorf("sample %d labels = %v", i, smp.Labels)
+		}
+		if smp.Values["AvgLatency"] <= 0 {
+			t.Errorf("sample %d AvgLatency = %v, want a latency", i, smp.Values["AvgLatency"])
+		}
+		if i > 0 && smp.Values["AccessAmount"] < samples[i-1].Values["AccessAmount"] {
+			t.Errorf("AccessAmount went down from %v to %v", samples[i-1].Values["AccessAmount"], smp.Values["AccessAmount"])
+		}
+	}
+}
+
+func TestSimulateWithConfigFile(t *testing.T) {
+	t.Setenv("SIMULATE", "steady")
+	t.Setenv("CONFIG_FILE", "targets.json")
+	err := simulate()
+	if err == nil || !strings.Contains(err.Error(), "CONFIG_FILE") {
+		t.Errorf("SIMULATE with CONFIG_FILE = %v, want an error", err)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxDatagram is the most bytes sent in one UDP packet, under the usual
+// Ethernet MTU so packets are not fragmented.
+const maxDatagram = 1432
+
+// sinkConfig is an output listed in the config file. Targets forward their
+// samples to the sinks they name.
+type sinkConfig struct {
+	Name string `json:"name"`
+	// Type is influxdb for the InfluxDB line protocol, statsd or
+	// dogstatsd.
+	Type string `json:"type"`
+	// URL is where samples go: http(s)://host:8086/write?db=apps for
+	// InfluxDB over HTTP, or udp://host:port.
+	URL string `json:"url"`
+	// Prefix is prepended to every measurement or metric name.
+	Prefix string `json:"prefix,omitempty"`
+	// Tags are added to every sample, overriding labels of the same name.
+	// Plain StatsD has no tags and ignores them.
+	Tags map[string]string `json:"tags,omitempty"`
+	// Headers are sent with every HTTP request, such as an Authorization
+	// token.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// validateSinks checks the sinks of cfg and the sinks its targets name.
+func validateSinks(cfg *config) error {
+	sinks := map[string]bool{}
+	for _, s := range cfg.Sinks {
+		if len(s.Name) == 0 {
+			return fmt.Errorf("sink %q needs a name", s.URL)
+		}
+		if s.Name == "remote_write" || s.Name == "otlp" {
+			// The exporters of REMOTE_WRITE_URL and OTLP_URL are counted
+			// under these names.
+			return fmt.Errorf("sink name %s is reserved", s.Name)
+		}
+		if sinks[s.Name] {
+			return fmt.Errorf("duplicate sink %s", s.Name)
+		}
+		sinks[s.Name] = true
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			return fmt.Errorf("sink %s: %v", s.Name, err)
+		}
+		switch {
+		case s.Type == "influxdb" && (u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "udp"):
+		case (s.Type == "statsd" || s.Type == "dogstatsd") && u.Scheme == "udp":
+		case s.Type == "influxdb":
+			return fmt.Errorf("sink %s: invalid url %q, want http, https or udp", s.Name, s.URL)
+		case s.Type == "statsd" || s.Type == "dogstatsd":
+			return fmt.Errorf("sink %s: invalid url %q, want udp://host:port", s.Name, s.URL)
+		default:
+			return fmt.Errorf("sink %s: unknown type %q, want influxdb, statsd or dogstatsd", s.Name, s.Type)
+		}
+	}
+	for _, t := range cfg.Targets {
+		for _, name := range t.Sinks {
+			if !sinks[name] {
+				return fmt.Errorf("target %s: unknown sink %s", t.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// newSink returns the exporter of a sink, forwarding the samples of
+// targets.
+func newSink(s sinkConfig, targets map[string]bool) (exporter, error) {
+	u, _ := url.Parse(s.URL)
+	var format func(exportSample) []string
+	switch s.Type {
+	case "influxdb":
+		format = s.influxLine
+	case "statsd":
+		format = s.statsdLines
+	case "dogstatsd":
+		format = s.dogstatsdLine
+	}
+	if u.Scheme == "udp" {
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %v", s.Name, err)
+		}
+		return &udpSink{sinkName: s.Name, conn: conn, format: format, targets: targets}, nil
+	}
+	q, err := newQueueExporter(s.Name, s.URL, defaultQueueConfig, func(batch []exportSample) ([]byte, http.Header) {
+		var lines []string
+		for _, smp := range batch {
+			lines = append(lines, format(smp)...)
+		}
+		header := http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+		for k, v := range s.Headers {
+			header.Set(k, v)
+		}
+		return []byte(strings.Join(lines, "\n") + "\n"), header
+	})
+	if err != nil {
+		return nil, err
+	}
+	q.targets = targets
+	return q, nil
+}
+
+// tags returns the labels of smp but its name, with the tags of s, sorted by
+// name. Empty values are left out.
+func (s sinkConfig) tags(smp exportSample) ([]exportLabel, string) {
+	var name string
+	tags := map[string]string{}
+	for _, l := range smp.Labels {
+		if l.Name == "__name__" {
+			name = l.Value
+			continue
+		}
+		tags[l.Name] = l.Value
+	}
+	for k, v := range s.Tags {
+		tags[k] = v
+	}
+	var sorted []exportLabel
+	for k, v := range tags {
+		if len(v) > 0 {
+			sorted = append(sorted, exportLabel{k, v})
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted, name
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// influxLine formats smp in the InfluxDB line protocol: a measurement named
+// after the value, tagged with its labels, with a value field, e.g.
+//
+//	AvgLatency,app=test-app,domain=test-domain,host=node-1 value=48 1514808000000000000
+func (s sinkConfig) influxLine(smp exportSample) []string {
+	tags, name := s.tags(smp)
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(s.Prefix + name))
+	for _, t := range tags {
+		b.WriteString("," + influxTagEscaper.Replace(t.Name) + "=" + influxTagEscaper.Replace(t.Value))
+	}
+	b.WriteString(" value=" + strconv.FormatFloat(smp.Value, 'f', -1, 64))
+	b.WriteString(" " + strconv.FormatInt(smp.Timestamp*1e6, 10))
+	return []string{b.String()}
+}
+
+var (
+	statsdEscaper       = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+	dogstatsdTagEscaper = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_")
+)
+
+// statsdLines formats smp as a StatsD gauge. Without tags the app is part
+// of the name, e.g. prefix.test-app.AvgLatency:48|g. Negative values are
+// set from zero, as a plain signed value changes a StatsD gauge.
+func (s sinkConfig) statsdLines(smp exportSample) []string {
+	tags, name := s.tags(smp)
+	for _, t := range tags {
+		if t.Name == "app" {
+			name = t.Value + "." + name
+		}
+	}
+	name = statsdEscaper.Replace(s.Prefix + name)
+	value := strconv.FormatFloat(smp.Value, 'f', -1, 64)
+	if smp.Value < 0 {
+		return []string{name + ":0|g", name + ":" + value + "|g"}
+	}
+	return []string{name + ":" + value + "|g"}
+}
+
+// dogstatsdLine formats smp as a DogStatsD gauge with its labels as tags,
+// e.g. prefix.AvgLatency:48|g|#app:test-app,host:node-1.
+func (s sinkConfig) dogstatsdLine(smp exportSample) []string {
+	tags, name := s.tags(smp)
+	line := statsdEscaper.Replace(s.Prefix+name) + ":" + strconv.FormatFloat(smp.Value, 'f', -1, 64) + "|g"
+	if len(tags) > 0 {
+		pairs := make([]string, len(tags))
+		for i, t := range tags {
+			pairs[i] = statsdEscaper.Replace(t.Name) + ":" + dogstatsdTagEscaper.Replace(t.Value)
+		}
+		line += "|#" + strings.Join(pairs, ",")
+	}
+	return []string{line}
+}
+
+// udpSink sends every sample as soon as it is scraped, packing lines into
+// datagrams. UDP has no acknowledgement, so nothing is queued or retried.
+type udpSink struct {
+	sinkName string
+	conn     net.Conn
+	format   func(exportSample) []string
+	targets  map[string]bool
+}
+
+func (u *udpSink) name() string {
+	return u.sinkName
+}
+
+func (u *udpSink) export(t target, smp sample) {
+	if !u.targets[t.Name] {
+		return
+	}
+	samples := exportSamples(t, smp)
+	var lines []string
+	for _, s := range samples {
+		lines = append(lines, u.format(s)...)
+	}
+	for _, packet := range packDatagrams(lines) {
+		if _, err := u.conn.Write(packet); err != nil {
+			exportRequests.inc(u.name(), "error")
+			logger.Debug("sending to sink failed", "sink", u.name(), "error", err)
+			continue
+		}
+		exportRequests.inc(u.name(), "sent")
+	}
+	exportedSamples.add(float64(len(samples)), u.name(), "sent")
+}
+
+// packDatagrams joins lines with newlines into packets of at most
+// maxDatagram bytes. A longer line gets a packet of its own.
+func packDatagrams(lines []string) [][]byte {
+	var packets [][]byte
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > maxDatagram {
+			packets = append(packets, packet)
+			packet = nil
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+func (u *udpSink) run(ctx context.Context) {
+	<-ctx.Done()
+}
+
+func (u *udpSink) close(deadline context.Context) error {
+	return u.conn.Close()
+}
+
+func (u *udpSink) pending() int {
+	return 0
+}
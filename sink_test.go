@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSinkFormats(t *testing.T) {
+	smp := sample{
+		Time:   time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC),
+		Labels: map[string]string{"app": "test-app", "domain": "test domain", "host": ""},
+		Values: map[string]float64{"AvgLatency": 48, "Delta": -2},
+	}
+	samples := exportSamples(target{Name: "test"}, smp)
+	for _, c := range []struct {
+		sink sinkConfig
+		want []string
+	}{
+		{sinkConfig{Type: "influxdb", Prefix: "k8s_", Tags: map[string]string{"env": "prod"}}, []string{
+			`k8s_AvgLatency,app=test-app,domain=test\ domain,env=prod,target=test value=48 1514808000000000000`,
+			`k8s_Delta,app=test-app,domain=test\ domain,env=prod,target=test value=-2 1514808000000000000`,
+		}},
+		{sinkConfig{Type: "statsd", Prefix: "k8s."}, []string{
+			"k8s.test-app.AvgLatency:48|g",
+			"k8s.test-app.Delta:0|g",
+			"k8s.test-app.Delta:-2|g",
+		}},
+		{sinkConfig{Type: "dogstatsd", Tags: map[string]string{"target": "override"}}, []string{
+			"AvgLatency:48|g|#app:test-app,domain:test domain,target:override",
+			"Delta:-2|g|#app:test-app,domain:test domain,target:override",
+		}},
+	} {
+		format := map[string]func(exportSample) []string{
+			"influxdb": c.sink.influxLine, "statsd": c.sink.statsdLines, "dogstatsd": c.sink.dogstatsdLine,
+		}[c.sink.Type]
+		var got []string
+		for _, s := range samples {
+			got = append(got, format(s)...)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s lines = %q, want %q", c.sink.Type, got, c.want)
+		}
+	}
+
+	lines := []string{strings.Repeat("a", 1000), strings.Repeat("b", 431), "c", strings.Repeat("d", 2000)}
+	packets := packDatagrams(lines)
+	if len(packets) != 3 || len(packets[0]) != 1432 || string(packets[1]) != "c" || len(packets[2]) != 2000 {
+		t.Errorf("packets of %d, %d, %d and %d bytes", len(lines[0]), len(lines[1]), len(lines[2]), len(lines[3]))
+	}
+}
+
+func TestSinks(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bodies := make(chan string, 1)
+	influx := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/write" || req.Header.Get("Authorization") != "Token secret" {
+			http.Error(res, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies <- string(body)
+		res.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+
+	cfg := &config{
+		Targets: []target{{Name: "orders", Sinks: []string{"statsd", "influx"}}, {Name: "search"}},
+		Sinks: []sinkConfig{
+			{Name: "statsd", Type: "dogstatsd", URL: "udp://" + conn.LocalAddr().String()},
+			{Name: "influx", Type: "influxdb", URL: influx.URL + "/write?db=apps", Headers: map[string]string{"Authorization": "Token secret"}},
+		},
+	}
+	if err := validateSinks(cfg); err != nil {
+		t.Fatal(err)
+	}
+	exporters, err := newExporters(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smp := sample{Time: time.Unix(1, 0), Labels: map[string]string{"app": "orders"}, Values: map[string]float64{"AccessAmount": 80}}
+	for _, e := range exporters {
+		e.export(cfg.Targets[1], smp)
+		e.export(cfg.Targets[0], smp)
+	}
+
+	buf := make([]byte, maxDatagram)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "AccessAmount:80|g|#app:orders,target:orders"; got != want {
+		t.Errorf("statsd packet = %q, want %q", got, want)
+	}
+
+	if err := exporters[1].(*queueExporter).flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := <-bodies, "AccessAmount,app=orders,target=orders value=80 1000000000\n"; got != want {
+		t.Errorf("influx body = %q, want %q", got, want)
+	}
+	for _, e := range exporters {
+		e.close(context.Background())
+	}
+
+	for _, c := range []struct {
+		sinks   []sinkConfig
+		targets []target
+	}{
+		{[]sinkConfig{{Name: "a", Type: "statsd", URL: "http://localhost:8125"}}, nil},
+		{[]sinkConfig{{Name: "a", Type: "graphite", URL: "udp://localhost:2003"}}, nil},
+		{[]sinkConfig{{Name: "a", Type: "statsd", URL: "udp://localhost:8125"}, {Name: "a", Type: "statsd", URL: "udp://localhost:8126"}}, nil},
+		{nil, []target{{Name: "orders", Sinks: []string{"missing"}}}},
+		{[]sinkConfig{{Name: "remote_write", Type: "statsd", URL: "udp://localhost:8125"}}, nil},
+		{[]sinkConfig{{Name: "otlp", Type: "influxdb", URL: "http://influxdb:8086/write"}}, nil},
+	} {
+		if err := validateSinks(&config{Sinks: c.sinks, Targets: c.targets}); err == nil {
+			t.Errorf("sinks %v of targets %v are valid, want an error", c.sinks, c.targets)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	chart "github.com/wcharczuk/go-chart"
+)
+
+// sloBurnWindow is the recent window the current burn rate and the projected
+// exhaustion are computed over.
+const sloBurnWindow = time.Hour
+
+// slo is a service level objective of a target. Without a field it asks for
+// the share of requests that succeed, from the AccessAmount and FailAmount
+// counters. With a field it asks for the share of samples whose value
+// compares to the threshold, e.g. AvgLatency < 50.
+type slo struct {
+	Name      string  `json:"name"`
+	Objective float64 `json:"objective"`
+	Window    string  `json:"window"`
+	Field     string  `json:"field,omitempty"`
+	Op        string  `json:"op,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+
+	window time.Duration
+}
+
+func (o *slo) validate() error {
+	if len(o.Name) == 0 {
+		return fmt.Errorf("slo needs a name")
+	}
+	if o.Objective <= 0 || o.Objective >= 1 {
+		return fmt.Errorf("slo %s: invalid objective %v, want a ratio such as 0.995", o.Name, o.Objective)
+	}
+	var err error
+	if o.window, err = parseDuration(o.Window); err != nil {
+		return fmt.Errorf("slo %s: invalid window %q", o.Name, o.Window)
+	}
+	if len(o.Field) > 0 {
+		if _, ok := compareOps[o.Op]; !ok {
+			return fmt.Errorf("slo %s: invalid op %q, want one of < <= > >=", o.Name, o.Op)
+		}
+	}
+	return nil
+}
+
+var compareOps = map[string]func(a, b float64) bool{
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+}
+
+// String describes the objective, e.g. 99.5% of requests succeed over 30d.
+func (o slo) String() string {
+	if len(o.Field) == 0 {
+		return fmt.Sprintf("%g%% of requests succeed over %s", o.Objective*100, o.Window)
+	}
+	return fmt.Sprintf("%s %s %g for %g%% of samples over %s", o.Field, o.Op, o.Threshold, o.Objective*100, o.Window)
+}
+
+// events returns the good and total events cur adds to the objective. prev is
+// the sample before cur, or nil.
+func (o slo) events(prev *sample, cur sample) (good, total float64) {
+	if len(o.Field) > 0 {
+		v, ok := cur.Values[o.Field]
+		if !ok {
+			return 0, 0
+		}
+		if compareOps[o.Op](v, o.Threshold) {
+			return 1, 1
+		}
+		return 0, 1
+	}
+	if prev == nil {
+		return 0, 0
+	}
+	access, fail, ok := requestIncrease(*prev, cur)
+	if !ok {
+		return 0, 0
+	}
+	return access - fail, access
+}
+
+// sloStatus is the error budget report of an objective.
+type sloStatus struct {
+	Target    string  `json:"target"`
+	Name      string  `json:"name"`
+	Objective float64 `json:"objective"`
+	Window    string  `json:"window"`
+	Summary   string  `json:"summary"`
+	Good      float64 `json:"good"`
+	Total     float64 `json:"total"`
+	// BudgetRemaining is the share of the error budget left, negative once
+	// the objective is missed.
+	BudgetRemaining float64 `json:"budget_remaining"`
+	// BurnRate is how fast the budget was spent over the last hour, where
+	// 1 spends it exactly over the window.
+	BurnRate float64 `json:"burn_rate"`
+	// ProjectedExhaustion is when the budget runs out at the current burn
+	// rate, unset while the budget is not being spent.
+	ProjectedExhaustion *time.Time `json:"projected_exhaustion,omitempty"`
+	// Coverage is how much of the window the stored samples cover.
+	Coverage string `json:"coverage"`
+}
+
+// budgetPoint is the remaining error budget at a point in time.
+type budgetPoint struct {
+	Time      time.Time
+	Remaining float64
+}
+
+// remainingBudget returns the share of the error budget of objective left
+// after bad of total events.
+func remainingBudget(objective, good, total float64) float64 {
+	if total <= 0 {
+		return 1
+	}
+	return 1 - (total-good)/total/(1-objective)
+}
+
+// evaluate reports objective o of target over samples, oldest first, at now.
+// It also returns the burn-down of the remaining budget over the window.
+func (o slo) evaluate(target string, samples []sample, now time.Time) (sloStatus, []budgetPoint) {
+	status := sloStatus{
+		Target:    target,
+		Name:      o.Name,
+		Objective: o.Objective,
+		Window:    o.Window,
+		Summary:   o.String(),
+	}
+	since := now.Add(-o.window)
+	recent := now.Add(-sloBurnWindow)
+	var recentGood, recentTotal float64
+	var burnDown []budgetPoint
+	var first time.Time
+	for i := range samples {
+		cur := samples[i]
+		if cur.Time.Before(since) {
+			continue
+		}
+		var prev *sample
+		if i > 0 && !samples[i-1].Time.Before(since) {
+			prev = &samples[i-1]
+		}
+		if first.IsZero() {
+			first = cur.Time
+		}
+		good, total := o.events(prev, cur)
+		status.Good += good
+		status.Total += total
+		if cur.Time.After(recent) {
+			recentGood += good
+			recentTotal += total
+		}
+		burnDown = append(burnDown, budgetPoint{cur.Time, remainingBudget(o.Objective, status.Good, status.Total)})
+	}
+	status.BudgetRemaining = remainingBudget(o.Objective, status.Good, status.Total)
+	if recentTotal > 0 {
+		status.BurnRate = (recentTotal - recentGood) / recentTotal / (1 - o.Objective)
+	}
+	if status.BurnRate > 0 && status.BudgetRemaining > 0 {
+		// At burn rate 1 the whole budget lasts one window.
+		left := time.Duration(status.BudgetRemaining / status.BurnRate * float64(o.window))
+		at := now.Add(left)
+		status.ProjectedExhaustion = &at
+	} else if status.BudgetRemaining <= 0 && status.Total > 0 {
+		status.ProjectedExhaustion = &now
+	}
+	if !first.IsZero() {
+		status.Coverage = now.Sub(first).Round(time.Second).String()
+	}
+	return status, burnDown
+}
+
+// renderBurnDownChart draws the remaining error budget over time.
+func renderBurnDownChart(w io.Writer, title string, points []budgetPoint, opts chartOptions) error {
+	if len(points) < 2 {
+		return fmt.Errorf("not enough samples to chart")
+	}
+	ts := chart.TimeSeries{Name: "budget remaining"}
+	zero := chart.TimeSeries{
+		Name:  "exhausted",
+		Style: chart.Style{Show: true, StrokeColor: chart.ColorRed, StrokeDashArray: []float64{5, 5}},
+	}
+	for _, p := range points {
+		ts.XValues = append(ts.XValues, p.Time)
+		ts.YValues = append(ts.YValues, p.Remaining*100)
+	}
+	zero.XValues = []time.Time{points[0].Time, points[len(points)-1].Time}
+	zero.YValues = []float64{0, 0}
+	c := chart.Chart{
+		Title:      title,
+		TitleStyle: chart.Style{Show: true},
+		Width:      opts.Width,
+		Height:     opts.Height,
+		XAxis: chart.XAxis{
+			Style:          chart.Style{Show: true},
+			ValueFormatter: chart.TimeValueFormatterWithFormat("01-02 15:04"),
+		},
+		YAxis: chart.YAxis{
+			Name:      "error budget remaining (%)",
+			NameStyle: chart.Style{Show: true},
+			Style:     chart.Style{Show: true},
+			Range:     &chart.ContinuousRange{Min: math.Min(0, minRemaining(points)*100), Max: 100},
+		},
+		Series: []chart.Series{ts, zero},
+	}
+	return render(w, c, opts)
+}
+
+func minRemaining(points []budgetPoint) float64 {
+	min := 1.0
+	for _, p := range points {
+		min = math.Min(min, p.Remaining)
+	}
+	return min
+}
+
+// sloStatuses evaluates the objectives of every target, or of the named one.
+func sloStatuses(cfg *config, s *store, name string, now time.Time) ([]sloStatus, error) {
+	targets := cfg.Targets
+	if len(name) > 0 {
+		t, err := cfg.target(name)
+		if err != nil {
+			return nil, err
+		}
+		targets = []target{t}
+	}
+	statuses := []sloStatus{}
+	for _, t := range targets {
+		for _, o := range t.SLOs {
+			status, _ := o.evaluate(t.Name, s.samplesSince(t.Name, now.Add(-o.window)), now)
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses, nil
+}
+
+// apiSLO serves the error budget reports of every objective as JSON.
+func apiSLO(cfg *config, s *store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		statuses, err := sloStatuses(cfg, s, req.URL.Query().Get("target"), time.Now())
+		if err != nil {
+			writeJSONError(res, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, statuses)
+	}
+}
+
+// sloChart serves the burn-down chart of an objective, cached for the scrape
+// interval of its target.
+func sloChart(cfg *config, s *store, charts *renderCache) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		opts, err := parseChartOptions(req)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := req.URL.Query()
+		t, err := cfg.target(q.Get("target"))
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusNotFound)
+			return
+		}
+		for _, o := range t.SLOs {
+			if o.Name != q.Get("slo") {
+				continue
+			}
+			charts.serve(res, req, chartKey(req), chartFormats[opts.Format].contentType, cfg.scrapeInterval(t), func() (int, []byte) {
+				now := time.Now()
+				_, points := o.evaluate(t.Name, s.samplesSince(t.Name, now.Add(-o.window)), now)
+				var buf bytes.Buffer
+				status := http.StatusOK
+				if err := renderBurnDownChart(&buf, t.Name+": "+o.String(), points, opts); err != nil {
+					l := requestLogger(req)
+					l.Error("drawing burn-down chart failed", "target", t.Name, "slo", o.Name, "error", err)
+					buf.Reset()
+					status = http.StatusServiceUnavailable
+					if err := renderErrorChart(&buf, err, opts); err != nil {
+						l.Error("rendering error chart failed", "error", err)
+					}
+				}
+				return status, buf.Bytes()
+			})
+			return
+		}
+		http.Error(res, fmt.Sprintf("target %s has no slo %q", t.Name, q.Get("slo")), http.StatusNotFound)
+	}
+}
+
+var sloPage = template.Must(template.New("slo").Funcs(template.FuncMap{
+	"percent": func(v float64) string { return fmt.Sprintf("%.2f%%", v*100) },
+	"chartURL": func(s sloStatus) string {
+		return "/slo/chart?" + url.Values{"target": {s.Target}, "slo": {s.Name}}.Encode()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>SLO status</title></head>
+<body>
+<h1>SLO status</h1>
+{{if not .}}<p>No SLOs are configured.</p>{{end}}
+{{range .}}
+<h2>{{.Target}}: {{.Name}}</h2>
+<p>{{.Summary}}</p>
+<table>
+<tr><th align="left">Budget remaining</th><td>{{percent .BudgetRemaining}}</td></tr>
+<tr><th align="left">Burn rate (1h)</th><td>{{printf "%.2f" .BurnRate}}</td></tr>
+<tr><th align="left">Projected exhaustion</th><td>{{with .ProjectedExhaustion}}{{.Format "2006-01-02 15:04:05 MST"}}{{else}}not spending budget{{end}}</td></tr>
+<tr><th align="left">Good / total</th><td>{{.Good}} / {{.Total}}</td></tr>
+<tr><th align="left">Data covers</th><td>{{.Coverage}} of {{.Window}}</td></tr>
+</table>
+<img src="{{chartURL .}}" alt="burn-down of {{.Name}}">
+{{end}}
+</body>
+</html>
+`))
+
+// sloStatusPage serves the error budget reports as HTML.
+func sloStatusPage(cfg *config, s *store) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		statuses, err := sloStatuses(cfg, s, req.URL.Query().Get("target"), time.Now())
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusNotFound)
+			return
+		}
+		res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := sloPage.Execute(res, statuses); err != nil {
+			requestLogger(req).Error("rendering slo page failed", "error", err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSLORequests(t *testing.T) {
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	o := slo{Name: "availability", Objective: 0.99, Window: "2h", window: 2 * time.Hour}
+	var samples []sample
+	// 1000 requests per minute: 0.5% fail in the first hour, 1% in the second.
+	for i := 0; i <= 120; i++ {
+		fail := float64(i) * 5
+		if i > 60 {
+			fail = 300 + float64(i-60)*10
+		}
+		samples = append(samples, requestSample(start.Add(time.Duration(i)*time.Minute), float64(i)*1000, fail))
+	}
+	now := start.Add(120 * time.Minute)
+	status, burnDown := o.evaluate("app", samples, now)
+
+	if status.Total != 120000 || status.Good != 120000-900 {
+		t.Errorf("good/total = %v/%v, want 119100/120000", status.Good, status.Total)
+	}
+	if want := 1 - 0.0075/0.01; math.Abs(status.BudgetRemaining-want) > 1e-9 {
+		t.Errorf("budget remaining = %v, want %v", status.BudgetRemaining, want)
+	}
+	if math.Abs(status.BurnRate-1) > 1e-9 {
+		t.Errorf("burn rate = %v, want 1", status.BurnRate)
+	}
+	// The remaining quarter of the budget lasts a quarter of the window.
+	if status.ProjectedExhaustion == nil || !status.ProjectedExhaustion.Equal(now.Add(30*time.Minute)) {
+		t.Errorf("projected exhaustion = %v, want %v", status.ProjectedExhaustion, now.Add(30*time.Minute))
+	}
+	if len(burnDown) != len(samples) || burnDown[len(burnDown)-1].Remaining != status.BudgetRemaining {
+		t.Errorf("burn-down does not end at the remaining budget")
+	}
+}
+
+func TestSLOThreshold(t *testing.T) {
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	o := slo{Name: "latency", Objective: 0.9, Window: "1h", window: time.Hour, Field: "AvgLatency", Op: "<", Threshold: 50}
+	var samples []sample
+	for i := 0; i < 10; i++ {
+		latency := 20.0
+		if i == 3 {
+			latency = 80
+		}
+		samples = append(samples, sample{Time: start.Add(time.Duration(i) * time.Minute), Values: map[string]float64{"AvgLatency": latency}})
+	}
+	status, _ := o.evaluate("app", samples, start.Add(10*time.Minute))
+	if status.Good != 9 || status.Total != 10 {
+		t.Errorf("good/total = %v/%v, want 9/10", status.Good, status.Total)
+	}
+	if math.Abs(status.BudgetRemaining) > 1e-9 || status.ProjectedExhaustion == nil {
+		t.Errorf("budget remaining = %v, exhaustion %v, want the budget exhausted", status.BudgetRemaining, status.ProjectedExhaustion)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for s, want := range map[string]time.Duration{"30d": 30 * 24 * time.Hour, "4w": 28 * 24 * time.Hour, "90m": 90 * time.Minute} {
+		if got, err := parseDuration(s); err != nil || got != want {
+			t.Errorf("parseDuration(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "d", "0d", "-1h", "1x"} {
+		if _, err := parseDuration(s); err == nil {
+			t.Errorf("parseDuration(%q) should fail", s)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sample is one scrape result of a target: named values and the labels
+// describing where they come from, such as app, domain and host.
+type sample struct {
+	Time   time.Time          `json:"time"`
+	Labels map[string]string  `json:"labels"`
+	Values map[string]float64 `json:"values"`
+}
+
+// ring is a fixed size buffer keeping the newest samples of a target.
+type ring struct {
+	samples []sample
+	next    int
+	full    bool
+}
+
+func (r *ring) add(s sample) {
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// last returns the newest buffered sample.
+func (r *ring) last() (sample, bool) {
+	if !r.full && r.next == 0 {
+		return sample{}, false
+	}
+	return r.samples[(r.next+len(r.samples)-1)%len(r.samples)], true
+}
+
+// all returns the buffered samples, oldest first.
+func (r *ring) all() []sample {
+	if !r.full {
+		return append([]sample(nil), r.samples[:r.next]...)
+	}
+	return append(append([]sample(nil), r.samples[r.next:]...), r.samples[:r.next]...)
+}
+
+// store keeps the recent samples of every target in memory. When a path is
+// set the samples are loaded from it on start and written back by flush.
+type store struct {
+	mu       sync.RWMutex
+	capacity int
+	path     string
+	series   map[string]*ring
+}
+
+func newStore(capacity int, path string) (*store, error) {
+	s := &store{capacity: capacity, path: path, series: map[string]*ring{}}
+	if len(path) == 0 {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot map[string][]sample
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	for name, samples := range snapshot {
+		for _, smp := range samples {
+			s.add(name, smp)
+		}
+	}
+	return s, nil
+}
+
+// add appends smp to the samples of target and returns it as stored. The
+// lookups by time need the samples in time order, so a sample older than the
+// newest one, such as a push racing another push or a stale marker, is stored
+// at the time of the newest one.
+func (s *store) add(target string, smp sample) sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.series[target]
+	if !ok {
+		r = &ring{samples: make([]sample, s.capacity)}
+		s.series[target] = r
+	}
+	if last, ok := r.last(); ok && smp.Time.Before(last.Time) {
+		smp.Time = last.Time
+	}
+	r.add(smp)
+	return smp
+}
+
+// samples returns the stored samples of target, oldest first.
+func (s *store) samples(target string) []sample {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.series[target]
+	if !ok {
+		return nil
+	}
+	return r.all()
+}
+
+// latest returns the newest sample of target.
+func (s *store) latest(target string) (sample, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.series[target]
+	if !ok {
+		return sample{}, false
+	}
+	return r.last()
+}
+
+// samplesSince returns the stored samples of target taken at or after since,
+// oldest first.
+func (s *store) samplesSince(target string, since time.Time) []sample {
+	samples := s.samples(target)
+	i := sort.Search(len(samples), func(i int) bool {
+		return !samples[i].Time.Before(since)
+	})
+	return samples[i:]
+}
+
+// samplesBetween returns the stored samples of target from from until before
+// to, oldest first.
+func (s *store) samplesBetween(target string, from, to time.Time) []sample {
+	samples := s.samplesSince(target, from)
+	i := sort.Search(len(samples), func(i int) bool {
+		return !samples[i].Time.Before(to)
+	})
+	return samples[:i]
+}
+
+// occupancy returns the number of stored samples per target.
+func (s *store) occupancy() map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := make(map[string]int, len(s.series))
+	for name, r := range s.series {
+		if r.full {
+			n[name] = len(r.samples)
+		} else {
+			n[name] = r.next
+		}
+	}
+	return n
+}
+
+// flush writes all samples to the storage path, replacing the file atomically.
+func (s *store) flush() error {
+	if len(s.path) == 0 {
+		return nil
+	}
+	s.mu.RLock()
+	snapshot := make(map[string][]sample, len(s.series))
+	for name, r := range s.series {
+		snapshot[name] = r.all()
+	}
+	s.mu.RUnlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".samples")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader keeps the serving certificate and the client CA pool in sync
+// with the files on disk, so a secret rotated by cert-manager is picked up
+// without restarting the pod.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	caPool  *x509.CertPool
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// latestModTime returns the newest modification time of the watched files.
+// Secret volumes swap a symlink on update, and os.Stat follows it.
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if f == "" {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.caFile)
+		}
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.caPool = pool
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// watch polls the files every interval and reloads them when they change,
+// until ctx is done. A failed reload keeps serving the previous certificate.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		modTime, err := r.latestModTime()
+		if err != nil {
+			logger.Error("checking TLS files failed", "error", err)
+			continue
+		}
+		r.mu.RLock()
+		changed := modTime.After(r.modTime)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.reload(); err != nil {
+			logger.Error("reloading TLS files failed", "error", err, "cert_file", r.certFile)
+			continue
+		}
+		logger.Info("reloaded TLS certificate", "cert_file", r.certFile)
+	}
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// tlsConfig builds the server TLS configuration from the environment. It
+// returns nil when TLS_CERT_FILE is unset and the agent should serve plain HTTP.
+// The certificate files are watched for changes until ctx is done.
+func tlsConfig(ctx context.Context) (*tls.Config, error) {
+	certFile := os.Getenv("TLS_CERT_FILE")
+	keyFile := os.Getenv("TLS_KEY_FILE")
+	caFile := os.Getenv("TLS_CLIENT_CA_FILE")
+	if len(certFile) == 0 {
+		return nil, nil
+	}
+	if len(keyFile) == 0 {
+		return nil, fmt.Errorf("TLS_KEY_FILE is required when TLS_CERT_FILE is set")
+	}
+
+	minVersion := os.Getenv("TLS_MIN_VERSION")
+	if len(minVersion) == 0 {
+		minVersion = "1.2"
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS_MIN_VERSION %q", minVersion)
+	}
+
+	clientAuth := tls.NoClientCert
+	if len(caFile) > 0 {
+		switch strings.ToLower(os.Getenv("TLS_CLIENT_AUTH")) {
+		case "", "require":
+			clientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			clientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("unsupported TLS_CLIENT_AUTH %q", os.Getenv("TLS_CLIENT_AUTH"))
+		}
+	}
+
+	interval, err := envDuration("TLS_RELOAD_INTERVAL", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	reloader, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.watch(ctx, interval)
+
+	config := &tls.Config{
+		MinVersion:     version,
+		ClientAuth:     clientAuth,
+		GetCertificate: reloader.getCertificate,
+	}
+	// The client CA pool can rotate too, so it is looked up per handshake.
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		reloader.mu.RLock()
+		c.ClientCAs = reloader.caPool
+		reloader.mu.RUnlock()
+		return c, nil
+	}
+	return config, nil
+}
+
+// probeTLSConfig returns the configuration of the listener serving the probe
+// endpoints: the certificate of c without client authentication. It returns
+// nil when c is nil.
+func probeTLSConfig(c *tls.Config) *tls.Config {
+	if c == nil {
+		return nil
+	}
+	return &tls.Config{MinVersion: c.MinVersion, GetCertificate: c.GetCertificate}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertPair writes a self-signed certificate for name and its key.
+func writeCertPair(t *testing.T, certFile, keyFile, name string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	first := writeCertPair(t, certFile, keyFile, "first")
+	r, err := newCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		r.watch(ctx, 10*time.Millisecond)
+		close(stopped)
+	}()
+	leaf := func() []byte {
+		cert, err := r.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Certificate[0]
+	}
+	if !bytes.Equal(leaf(), first) {
+		t.Fatal("serving another certificate than the one on disk")
+	}
+
+	second := writeCertPair(t, certFile, keyFile, "second")
+	// Modification times may be too coarse to tell both writes apart.
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !bytes.Equal(leaf(), second) {
+		if time.Now().After(deadline) {
+			t.Fatal("the rewritten certificate was not reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not stop with its context")
+	}
+}
+
+func TestTLSReloadInterval(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCertPair(t, certFile, keyFile, "agent")
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, interval := range []string{"0", "-1s", "soon"} {
+		t.Setenv("TLS_RELOAD_INTERVAL", interval)
+		if _, err := tlsConfig(ctx); err == nil {
+			t.Errorf("TLS_RELOAD_INTERVAL=%s succeeded, want an error", interval)
+		}
+	}
+	t.Setenv("TLS_RELOAD_INTERVAL", "1m")
+	if c, err := tlsConfig(ctx); err != nil || c == nil {
+		t.Errorf("tlsConfig() = %v, %v", c, err)
+	}
+}
+
+func TestProbeTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCertPair(t, certFile, keyFile, "agent")
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	t.Setenv("TLS_CLIENT_CA_FILE", certFile)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config, err := tlsConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// handshake returns the server side result of a handshake with a client
+	// presenting no certificate.
+	handshake := func(config *tls.Config) error {
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+			if err == nil {
+				conn.Read(make([]byte, 1))
+				conn.Close()
+			}
+		}()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.(*tls.Conn).Handshake()
+	}
+	if err := handshake(config); err == nil {
+		t.Error("main listener accepted a client without a certificate")
+	}
+	if err := handshake(probeTLSConfig(config)); err != nil {
+		t.Errorf("probe listener rejected a client without a certificate: %v", err)
+	}
+	if probeTLSConfig(nil) != nil {
+		t.Error("probe listener of a plain HTTP agent uses TLS")
+	}
+}